@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// MaxBatchBytes is the approximate size limit of a statement generated by
+// InsertBatch. Keep it below the server's max_allowed_packet.
+var MaxBatchBytes = 1 << 20
+
+// InsertBatch inserts the elements of list, a slice of structs or of
+// pointers to structs registered with DefaultDBMap, using multi-row
+// INSERT statements. Rows are split over several statements to stay
+// below the dialect's bind variable limit and MaxBatchBytes. Generated
+// auto-increment ids are assigned to every element.
+//
+// The statements are not run in a transaction; pass a transaction as exec
+// to insert all or nothing.
+func InsertBatch(exec Conn, list interface{}) error {
+	return InsertBatchContext(context.Background(), exec, list)
+}
+
+func InsertBatchContext(ctx context.Context, exec Conn, list interface{}) error {
+	return queryInsertBatch(ctx, DefaultDBMap, exec, list)
+}
+
+func queryInsertBatch(ctx context.Context, m *DbMap, exec Conn, list interface{}) error {
+	m = m.forConn(exec)
+
+	v := reflect.Indirect(reflect.ValueOf(list))
+
+	if v.Kind() != reflect.Slice {
+		return fmt.Errorf("InsertBatch list must be a slice, but got: %T", list)
+	}
+
+	if v.Len() == 0 {
+		return nil
+	}
+
+	var table *TableMap
+	elems := make([]reflect.Value, v.Len())
+	ptrs := make([]interface{}, v.Len())
+
+	for i := range elems {
+		e := v.Index(i)
+
+		if e.Kind() == reflect.Interface {
+			e = e.Elem()
+		}
+
+		if e.Kind() == reflect.Ptr {
+			e = e.Elem()
+		}
+
+		if e.Kind() != reflect.Struct || !e.CanAddr() {
+			return fmt.Errorf("InsertBatch element %d must be a struct or pointer to struct, but got: %s", i, e.Type())
+		}
+
+		t := m.TableForType(e.Type())
+
+		if t == nil {
+			return fmt.Errorf("Could not find table for %v", e.Type())
+		}
+
+		if table != nil && t != table {
+			return fmt.Errorf("InsertBatch elements must map to a single table, got %s and %s", table.TableName, t.TableName)
+		}
+
+		table = t
+		elems[i] = e
+		ptrs[i] = e.Addr().Interface()
+	}
+
+	ctx = withOp(ctx, opInsert, table.TableName)
+
+	for i, ptr := range ptrs {
+		if v, ok := ptr.(PreInserter); ok {
+			if err := v.PreInsert(exec); err != nil {
+				return err
+			}
+		}
+
+		if table.version != nil {
+			table.version.field(elems[i]).SetInt(1)
+		}
+	}
+
+	d := m.dialect()
+
+	for len(elems) > 0 {
+		n := batchSize(table, d, elems)
+		bi := table.bindInsertBatch(elems[:n])
+
+		if bi.autoIncrIdx > -1 {
+			ids, err := d.InsertAutoIncrBatch(ctx, exec, bi.query, n, bi.args...)
+
+			if err != nil {
+				return wrapError(ctx, connDialect(m, exec), opInsert, table.TableName, bi.query, err)
+			}
+
+			for i, id := range ids {
+				if !setAutoIncr(table.columns[bi.autoIncrIdx].field(elems[i]), id) {
+					return fmt.Errorf("Cannot set autoincrement value on non-Int field. SQL=%s  autoIncrIdx=%d", table.insertBindPlan().query, bi.autoIncrIdx)
+				}
+			}
+		} else {
+			if _, err := exec.ExecContext(ctx, bi.query, bi.args...); err != nil {
+				return wrapError(ctx, connDialect(m, exec), opInsert, table.TableName, bi.query, err)
+			}
+		}
+
+		for i, ptr := range ptrs[:n] {
+			table.takeSnapshot(elems[i])
+
+			if v, ok := ptr.(PostInserter); ok {
+				if err := v.PostInsert(exec); err != nil {
+					return err
+				}
+			}
+		}
+
+		elems = elems[n:]
+		ptrs = ptrs[n:]
+	}
+
+	return nil
+}
+
+// batchSize returns the number of leading elems that fit in a single
+// statement.
+func batchSize(table *TableMap, d Dialect, elems []reflect.Value) int {
+	plan := table.bindInsert(elems[0])
+	size := len(plan.query) + rowSize(plan.args)
+	n := 0
+
+	for _, elem := range elems {
+		if n > 0 {
+			if (n+1)*len(plan.args) > d.MaxBindVars() {
+				break
+			}
+
+			if size += rowSize(table.insertBindPlan().createBindInstance(elem).args); size > MaxBatchBytes {
+				break
+			}
+		}
+		n++
+	}
+	return n
+}
+
+// rowSize estimates the bytes taken by a row of values in a statement.
+func rowSize(args []interface{}) int {
+	size := 3
+
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			size += 2*len(v) + 3
+		case []byte:
+			size += 2*len(v) + 3
+		default:
+			size += 24
+		}
+	}
+	return size
+}
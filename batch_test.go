@@ -0,0 +1,87 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInsertBatch(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	defer func(n int) { MaxBatchBytes = n }(MaxBatchBytes)
+	MaxBatchBytes = 300
+
+	friends := make([]Friend, 7)
+	for i := range friends {
+		friends[i].Name = strings.Repeat("x", 40)
+	}
+
+	if err := InsertBatch(db, friends); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	for i, f := range friends {
+		if f.FriendID != i+1 {
+			t.Fatalf("expected %d got %d", i+1, f.FriendID)
+		}
+	}
+
+	notes := []*Note{{Body: "a"}, {Body: "b"}}
+
+	if err := InsertBatch(db, notes); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if notes[1].NoteID != 2 || notes[1].Version != 1 {
+		t.Fatalf("unexpected %+v", notes[1])
+	}
+
+	if cnt, _ := friendCount(db); cnt != 7 {
+		t.Fatalf("expected 7 got %d", cnt)
+	}
+
+	if err := InsertBatch(db, []interface{}{&Friend{}, &Note{}}); err == nil {
+		t.Fatalf("expected error for mixed tables")
+	}
+}
+
+func TestInsertBatchSql(t *testing.T) {
+	m := NewDbMap(PostgresDialect{})
+	table := m.AddTableWithName(Friend{}, "Friend").SetKeys(true, "FriendID")
+	friends := []Friend{{Name: "a"}, {Name: "b"}}
+	elems := []reflect.Value{reflect.ValueOf(&friends[0]).Elem(), reflect.ValueOf(&friends[1]).Elem()}
+
+	bi := table.bindInsertBatch(elems)
+	want := `INSERT INTO "Friend" ("FriendID","Name") VALUES (DEFAULT,$1),(DEFAULT,$2) RETURNING "FriendID";`
+
+	if bi.query != want {
+		t.Fatalf("expected %s got %s", want, bi.query)
+	}
+
+	if len(bi.args) != 2 || bi.args[1] != "b" {
+		t.Fatalf("unexpected args %v", bi.args)
+	}
+}
+
+func TestAutoIncrIds(t *testing.T) {
+	if got := autoIncrIds(11, 3, 10); !reflect.DeepEqual(got, []int64{11, 21, 31}) {
+		t.Fatalf("expected [11 21 31] got %v", got)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	defer func(n int) { MaxBatchBytes = n }(MaxBatchBytes)
+
+	friends := []Friend{{Name: strings.Repeat("x", 100)}, {Name: "y"}}
+	elems := []reflect.Value{reflectElem(&friends[0]), reflectElem(&friends[1])}
+	table := DefaultDBMap.TableFor(&friends[0])
+
+	// the statement and the first row leave no room for the second
+	MaxBatchBytes = len(table.bindInsert(elems[0]).query) + 210
+	if n := batchSize(table, SqliteDialect{}, elems); n != 1 {
+		t.Fatalf("expected 1 got %d", n)
+	}
+}
@@ -0,0 +1,365 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// SelectBuilder assembles a SELECT statement and its arguments.
+//
+// Conditions, joins and orderings are SQL fragments written with "?"
+// placeholders, which are replaced with the bind variables of the
+// dialect. Table and column names passed on their own, as to QueryTable,
+// Join and In, are quoted by the dialect. Select and Scalar use the
+// dialect of their connection if it is a *DB or *Tx, ToSql the dialect
+// of the DbMap.
+//
+//	var friends []Friend
+//	err := DefaultDBMap.TableFor(Friend{}).Query().
+//		Where("Name LIKE ?", "A%").
+//		In("FriendID", ids).
+//		OrderBy("Name").
+//		Limit(10).
+//		Select(db, &friends)
+type SelectBuilder struct {
+	dbmap   *DbMap
+	columns []string
+	table   string
+
+	joins   []string
+	where   string
+	groupBy []string
+	having  string
+	orderBy []string
+
+	joinArgs   []interface{}
+	whereArgs  []interface{}
+	havingArgs []interface{}
+
+	limit  int64
+	offset int64
+	err    error
+}
+
+// Query returns a builder selecting the columns of the table, see
+// ColumnsStr.
+func (t *TableMap) Query() *SelectBuilder {
+	var columns []string
+	for _, col := range t.columns {
+		if !col.Transient {
+			columns = append(columns, ident(t.TableName)+"."+ident(col.ColumnName))
+		}
+	}
+
+	return &SelectBuilder{
+		dbmap:   t.dbmap,
+		columns: []string{strings.Join(columns, ",")},
+		table:   t.TableName,
+		limit:   -1,
+		offset:  -1,
+	}
+}
+
+// QueryTable returns a builder selecting "*" from table. Use Columns to
+// select other columns.
+func (m *DbMap) QueryTable(table string) *SelectBuilder {
+	return &SelectBuilder{
+		dbmap:   m,
+		columns: []string{"*"},
+		table:   table,
+		limit:   -1,
+		offset:  -1,
+	}
+}
+
+// QueryTable returns a builder for table using DefaultDBMap.
+func QueryTable(table string) *SelectBuilder {
+	return DefaultDBMap.QueryTable(table)
+}
+
+// Columns replaces the selected columns with the given expressions.
+func (b *SelectBuilder) Columns(columns ...string) *SelectBuilder {
+	b.columns = columns
+	return b
+}
+
+// Where adds a condition that must hold in addition to the previous
+// ones. It is the same as And.
+func (b *SelectBuilder) Where(cond string, args ...interface{}) *SelectBuilder {
+	return b.And(cond, args...)
+}
+
+// And adds a condition that must hold in addition to the previous ones.
+func (b *SelectBuilder) And(cond string, args ...interface{}) *SelectBuilder {
+	if b.where == "" {
+		b.where = "(" + cond + ")"
+	} else {
+		b.where += " AND (" + cond + ")"
+	}
+	b.whereArgs = append(b.whereArgs, args...)
+	return b
+}
+
+// Or adds a condition that may hold instead of all the previous ones:
+// Where(a).And(b).Or(c) selects rows matching (a AND b) OR c.
+func (b *SelectBuilder) Or(cond string, args ...interface{}) *SelectBuilder {
+	if b.where == "" {
+		b.where = "(" + cond + ")"
+	} else {
+		b.where = "(" + b.where + ") OR (" + cond + ")"
+	}
+	b.whereArgs = append(b.whereArgs, args...)
+	return b
+}
+
+// In adds the condition that column, optionally qualified by its table,
+// is one of values, which must be a slice. An empty slice matches no
+// rows.
+func (b *SelectBuilder) In(column string, values interface{}) *SelectBuilder {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice {
+		b.setErr(fmt.Errorf("In: expected a slice for %s, got %T", column, values))
+		return b
+	}
+
+	if v.Len() == 0 {
+		return b.And("1=0")
+	}
+
+	args := make([]interface{}, v.Len())
+	for i := range args {
+		args[i] = v.Index(i).Interface()
+	}
+
+	marks := strings.Repeat(",?", len(args))[1:]
+	parts := strings.Split(column, ".")
+	for i, p := range parts {
+		parts[i] = ident(p)
+	}
+	return b.And(strings.Join(parts, ".")+" IN ("+marks+")", args...)
+}
+
+// Join adds an inner join of table on the condition on.
+func (b *SelectBuilder) Join(table, on string, args ...interface{}) *SelectBuilder {
+	return b.join("JOIN", table, on, args)
+}
+
+// LeftJoin adds a left outer join of table on the condition on.
+func (b *SelectBuilder) LeftJoin(table, on string, args ...interface{}) *SelectBuilder {
+	return b.join("LEFT JOIN", table, on, args)
+}
+
+func (b *SelectBuilder) join(kind, table, on string, args []interface{}) *SelectBuilder {
+	b.joins = append(b.joins, kind+" "+ident(table)+" ON "+on)
+	b.joinArgs = append(b.joinArgs, args...)
+	return b
+}
+
+// GroupBy adds expressions to the GROUP BY clause.
+func (b *SelectBuilder) GroupBy(exprs ...string) *SelectBuilder {
+	b.groupBy = append(b.groupBy, exprs...)
+	return b
+}
+
+// Having adds a condition on the groups that must hold in addition to
+// the previous ones.
+func (b *SelectBuilder) Having(cond string, args ...interface{}) *SelectBuilder {
+	if b.having == "" {
+		b.having = "(" + cond + ")"
+	} else {
+		b.having += " AND (" + cond + ")"
+	}
+	b.havingArgs = append(b.havingArgs, args...)
+	return b
+}
+
+// OrderBy adds expressions, such as "Name DESC", to the ORDER BY clause.
+func (b *SelectBuilder) OrderBy(exprs ...string) *SelectBuilder {
+	b.orderBy = append(b.orderBy, exprs...)
+	return b
+}
+
+// Limit sets the maximum number of rows returned.
+func (b *SelectBuilder) Limit(n int64) *SelectBuilder {
+	b.limit = n
+	return b
+}
+
+// Offset sets the number of rows skipped.
+func (b *SelectBuilder) Offset(n int64) *SelectBuilder {
+	b.offset = n
+	return b
+}
+
+// clone returns a copy of the builder that can be extended without
+// changing b.
+func (b *SelectBuilder) clone() *SelectBuilder {
+	c := *b
+	c.columns = append([]string(nil), b.columns...)
+	c.joins = append([]string(nil), b.joins...)
+	c.groupBy = append([]string(nil), b.groupBy...)
+	c.orderBy = append([]string(nil), b.orderBy...)
+	c.joinArgs = append([]interface{}(nil), b.joinArgs...)
+	c.whereArgs = append([]interface{}(nil), b.whereArgs...)
+	c.havingArgs = append([]interface{}(nil), b.havingArgs...)
+	return &c
+}
+
+func (b *SelectBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// ToSql returns the statement and its arguments.
+func (b *SelectBuilder) ToSql() (string, []interface{}, error) {
+	return b.toSql(b.dbmap.dialect())
+}
+
+// toSql returns the statement in the dialect d and its arguments.
+func (b *SelectBuilder) toSql(d Dialect) (string, []interface{}, error) {
+	if b.err != nil {
+		return "", nil, b.err
+	}
+
+	s := bytes.Buffer{}
+	s.WriteString("SELECT ")
+	s.WriteString(strings.Join(b.columns, ","))
+	s.WriteString(" FROM ")
+	s.WriteString(d.QuoteField(b.table))
+
+	for _, j := range b.joins {
+		s.WriteString(" ")
+		s.WriteString(j)
+	}
+
+	if b.where != "" {
+		s.WriteString(" WHERE ")
+		s.WriteString(b.where)
+	}
+
+	if len(b.groupBy) > 0 {
+		s.WriteString(" GROUP BY ")
+		s.WriteString(strings.Join(b.groupBy, ", "))
+	}
+
+	if b.having != "" {
+		s.WriteString(" HAVING ")
+		s.WriteString(b.having)
+	}
+
+	if len(b.orderBy) > 0 {
+		s.WriteString(" ORDER BY ")
+		s.WriteString(strings.Join(b.orderBy, ", "))
+	}
+
+	// an offset needs a limit in MySQL and SQLite
+	if b.limit >= 0 || b.offset >= 0 {
+		limit := b.limit
+		if limit < 0 {
+			limit = 1<<63 - 1
+		}
+		s.WriteString(" LIMIT ")
+		s.WriteString(strconv.FormatInt(limit, 10))
+	}
+
+	if b.offset >= 0 {
+		s.WriteString(" OFFSET ")
+		s.WriteString(strconv.FormatInt(b.offset, 10))
+	}
+
+	args := make([]interface{}, 0, len(b.joinArgs)+len(b.whereArgs)+len(b.havingArgs))
+	args = append(args, b.joinArgs...)
+	args = append(args, b.whereArgs...)
+	args = append(args, b.havingArgs...)
+
+	query, n := bindPlaceholders(d, quoteIdents(d, s.String()))
+	if n != len(args) {
+		return "", nil, fmt.Errorf("Query has %d placeholders but %d args: %s", n, len(args), query)
+	}
+
+	return query, args, nil
+}
+
+// Select runs the statement and scans the rows into dest, see Select.
+func (b *SelectBuilder) Select(conn Conn, dest interface{}) error {
+	return b.SelectContext(context.Background(), conn, dest)
+}
+
+func (b *SelectBuilder) SelectContext(ctx context.Context, conn Conn, dest interface{}) error {
+	query, args, err := b.toSql(connDialect(b.dbmap, conn))
+	if err != nil {
+		return err
+	}
+	return querySelect(ctx, b.dbmap, conn, dest, query, args...)
+}
+
+// Scalar runs the statement and returns the integer in the first column
+// of its first row, see Scalar.
+func (b *SelectBuilder) Scalar(conn Conn) (int64, error) {
+	return b.ScalarContext(context.Background(), conn)
+}
+
+func (b *SelectBuilder) ScalarContext(ctx context.Context, conn Conn) (int64, error) {
+	query, args, err := b.toSql(connDialect(b.dbmap, conn))
+	if err != nil {
+		return 0, err
+	}
+	return ScalarContext(ctx, conn, query, args...)
+}
+
+// identMark delimits the names that the builder quotes once the dialect
+// of the statement is known, see quoteIdents.
+const identMark = "\x00"
+
+// ident marks name to be quoted by quoteIdents.
+func ident(name string) string {
+	return identMark + name + identMark
+}
+
+// quoteIdents quotes the names marked by ident in s with d.
+func quoteIdents(d Dialect, s string) string {
+	if !strings.Contains(s, identMark) {
+		return s
+	}
+
+	parts := strings.Split(s, identMark)
+	for i := 1; i < len(parts); i += 2 {
+		parts[i] = d.QuoteField(parts[i])
+	}
+	return strings.Join(parts, "")
+}
+
+// bindPlaceholders replaces the "?" placeholders of query that are not
+// inside quotes with the bind variables of d and returns their number.
+func bindPlaceholders(d Dialect, query string) (string, int) {
+	s := bytes.Buffer{}
+	n := 0
+	var quote byte
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' && i+1 < len(query) {
+				s.WriteByte(c)
+				i++
+				c = query[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '?':
+			s.WriteString(d.BindVar(n))
+			n++
+			continue
+		}
+		s.WriteByte(c)
+	}
+	return s.String(), n
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectBuilderSql(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		query   string
+	}{
+		{
+			MySQLDialect{},
+			"SELECT f.Name,COUNT(*) FROM `Friend` JOIN `Note` ON Note.NoteID = f.FriendID AND Note.Body <> ? " +
+				"WHERE ((Name LIKE ?) AND (`f`.`FriendID` IN (?,?))) OR (Name = 'who?') " +
+				"GROUP BY f.Name HAVING (COUNT(*) > ?) ORDER BY f.Name DESC LIMIT 10 OFFSET 20",
+		},
+		{
+			PostgresDialect{},
+			`SELECT f.Name,COUNT(*) FROM "Friend" JOIN "Note" ON Note.NoteID = f.FriendID AND Note.Body <> $1 ` +
+				`WHERE ((Name LIKE $2) AND ("f"."FriendID" IN ($3,$4))) OR (Name = 'who?') ` +
+				`GROUP BY f.Name HAVING (COUNT(*) > $5) ORDER BY f.Name DESC LIMIT 10 OFFSET 20`,
+		},
+	}
+
+	for _, tt := range tests {
+		query, args, err := NewDbMap(tt.dialect).QueryTable("Friend").
+			Columns("f.Name", "COUNT(*)").
+			Join("Note", "Note.NoteID = f.FriendID AND Note.Body <> ?", "").
+			Where("Name LIKE ?", "A%").
+			In("f.FriendID", []int{1, 2}).
+			Or("Name = 'who?'").
+			GroupBy("f.Name").
+			Having("COUNT(*) > ?", 1).
+			OrderBy("f.Name DESC").
+			Limit(10).
+			Offset(20).
+			ToSql()
+
+		if err != nil {
+			t.Fatalf("expected nil got %v", err)
+		}
+
+		if query != tt.query {
+			t.Errorf("expected\n%s\ngot\n%s", tt.query, query)
+		}
+
+		if want := []interface{}{"", "A%", 1, 2, 1}; !reflect.DeepEqual(args, want) {
+			t.Errorf("expected %v got %v", want, args)
+		}
+	}
+
+	if _, _, err := QueryTable("Friend").Where("Name = ?").ToSql(); err == nil {
+		t.Errorf("expected error for missing args")
+	}
+
+	if _, _, err := QueryTable("Friend").In("FriendID", 1).ToSql(); err == nil {
+		t.Errorf("expected error for non-slice In")
+	}
+}
+
+func TestSelectBuilder(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	for _, name := range []string{"Ann", "Bob", "Cid"} {
+		if err := Insert(db, &Friend{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := DefaultDBMap.TableFor(Friend{})
+
+	var friends []Friend
+
+	err := table.Query().
+		Where("Name <> ?", "Ann").
+		OrderBy("Name DESC").
+		Offset(1).
+		Select(db, &friends)
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if len(friends) != 1 || friends[0].Name != "Bob" {
+		t.Fatalf("expected Bob got %v", friends)
+	}
+
+	n, err := table.Query().Columns("COUNT(*)").In("Name", []string{"Ann", "Cid"}).Scalar(db)
+
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2, nil got %d, %v", n, err)
+	}
+
+	n, err = table.Query().Columns("COUNT(*)").In("Name", []string{}).Scalar(db)
+
+	if err != nil || n != 0 {
+		t.Fatalf("expected 0, nil got %d, %v", n, err)
+	}
+}
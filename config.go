@@ -0,0 +1,379 @@
+package database
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrMissingDSN is returned by Open when Config has neither a DSN nor a
+// database to build one from.
+var ErrMissingDSN = errors.New("Missing DSN")
+
+// Config configures the connection pool opened by Open.
+type Config struct {
+	// Dialect of the database, MySQLDialect if nil.
+	Dialect Dialect
+
+	// Driver is the database/sql driver name, the DriverName of Dialect
+	// if empty.
+	Driver string
+
+	// DSN is passed to the driver as is. If empty, it is built from Addr,
+	// User, Password, Database, Params and TLS.
+	DSN string
+
+	// Addr is the "host:port" of the server. For SQLite Database is the
+	// path of the file, or ":memory:" for a private in-memory database.
+	Addr     string
+	User     string
+	Password string
+	Database string
+
+	// Params are additional driver parameters. MySQL DSNs have
+	// parseTime=true unless Params says otherwise.
+	Params map[string]string
+
+	// TLS, if not nil, enables encrypted connections to MySQL and
+	// Postgres. For MySQL it is registered with the driver until the DB
+	// is closed.
+	TLS *TLSConfig
+
+	// MaxOpenConns, MaxIdleConns, ConnMaxLifetime and ConnMaxIdleTime
+	// configure the pool as the methods of sql.DB of the same name. Zero
+	// keeps the defaults of database/sql.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// PingRetries is the number of times the startup ping is retried
+	// before Open fails. A negative value skips the ping.
+	PingRetries int
+
+	// PingBackoff is the wait before the first retry of the ping,
+	// 100ms if zero. It doubles with every retry up to MaxPingBackoff,
+	// 5s if zero.
+	PingBackoff    time.Duration
+	MaxPingBackoff time.Duration
+}
+
+// TLSConfig are the TLS settings of Config. All files are PEM encoded and
+// optional.
+type TLSConfig struct {
+	// CAFile holds the certificates used to verify the server, instead
+	// of the system roots.
+	CAFile string
+
+	// CertFile and KeyFile hold the client certificate and its key.
+	CertFile string
+	KeyFile  string
+
+	// ServerName is the name verified in the server certificate, the
+	// host of Addr if empty. It is ignored by Postgres.
+	ServerName string
+
+	// InsecureSkipVerify encrypts the connection without verifying the
+	// server certificate.
+	InsecureSkipVerify bool
+}
+
+// Open opens a connection pool with the settings of cfg and pings the
+// database, retrying with backoff while ctx allows, so that a database
+// that is still starting up does not fail the caller.
+//
+//	db, err := database.Open(ctx, database.Config{
+//		Addr:         "localhost:3306",
+//		User:         "app",
+//		Password:     password,
+//		Database:     "app",
+//		MaxOpenConns: 20,
+//		PingRetries:  5,
+//	})
+func Open(ctx context.Context, cfg Config) (*DB, error) {
+	db, err := open(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.PingRetries >= 0 {
+		if err := ping(ctx, db, cfg); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Could not connect to database: %w", err)
+		}
+	}
+	return db, nil
+}
+
+// open creates the pool of cfg without connecting to the database.
+func open(cfg Config) (*DB, error) {
+	dialect := cfg.Dialect
+	if dialect == nil {
+		dialect = MySQLDialect{}
+	}
+
+	driver := cfg.Driver
+	if driver == "" {
+		driver = dialect.DriverName()
+	}
+
+	dsn, tlsName := cfg.DSN, ""
+	if dsn == "" {
+		var err error
+		if dsn, tlsName, err = cfg.formatDSN(dialect); err != nil {
+			return nil, err
+		}
+	}
+
+	sqlxDb, err := sqlx.Open(driver, dsn)
+	if err != nil {
+		if tlsName != "" {
+			mysql.DeregisterTLSConfig(tlsName)
+		}
+		return nil, err
+	}
+
+	if cfg.MaxOpenConns > 0 {
+		sqlxDb.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		sqlxDb.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		sqlxDb.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
+	if cfg.ConnMaxIdleTime > 0 {
+		sqlxDb.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+	}
+
+	// every connection to a private in-memory database sees its own
+	// empty database, and a shared one is dropped with its last connection
+	if _, ok := dialect.(SqliteDialect); ok && sqliteInMemory(dsn) {
+		sqlxDb.SetMaxOpenConns(1)
+	}
+
+	db := newDB(sqlxDb, dialect)
+	db.tlsConfig = tlsName
+	return db, nil
+}
+
+// sqliteInMemory reports whether the SQLite dsn opens an in-memory
+// database: ":memory:", "file::memory:" or a URI with mode=memory.
+func sqliteInMemory(dsn string) bool {
+	if dsn == ":memory:" || strings.HasPrefix(dsn, "file::memory:") {
+		return true
+	}
+
+	i := strings.IndexByte(dsn, '?')
+	if i < 0 || !strings.HasPrefix(dsn, "file:") {
+		return false
+	}
+
+	params, err := url.ParseQuery(dsn[i+1:])
+	return err == nil && params.Get("mode") == "memory"
+}
+
+func ping(ctx context.Context, db *DB, cfg Config) error {
+	backoff := cfg.PingBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	maxBackoff := cfg.MaxPingBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 5 * time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil || attempt >= cfg.PingRetries {
+			return err
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// formatDSN builds the DSN of the driver of dialect from the fields of
+// cfg. For MySQL with TLS it also returns the name of the TLS config
+// registered with the driver, which the caller must deregister.
+func (cfg Config) formatDSN(dialect Dialect) (string, string, error) {
+	if cfg.Database == "" {
+		return "", "", ErrMissingDSN
+	}
+
+	switch dialect.(type) {
+	case MySQLDialect:
+		return cfg.mysqlDSN()
+	case PostgresDialect:
+		return cfg.postgresDSN(), "", nil
+	case SqliteDialect:
+		if cfg.TLS != nil {
+			return "", "", fmt.Errorf("TLS is not supported by SQLite")
+		}
+		if len(cfg.Params) == 0 {
+			return cfg.Database, "", nil
+		}
+		return "file:" + cfg.Database + "?" + encodeParams(cfg.Params), "", nil
+	default:
+		return "", "", fmt.Errorf("Cannot build a DSN for %T, set Config.DSN: %w", dialect, ErrMissingDSN)
+	}
+}
+
+// mysqlTLSConfigs numbers the TLS configurations registered with the
+// MySQL driver. Each DB deregisters its own on Close.
+var mysqlTLSConfigs uint64
+
+func (cfg Config) mysqlDSN() (string, string, error) {
+	c := mysql.NewConfig()
+	c.User = cfg.User
+	c.Passwd = cfg.Password
+	c.DBName = cfg.Database
+	c.ParseTime = true
+
+	if cfg.Addr != "" {
+		c.Net = "tcp"
+		c.Addr = cfg.Addr
+	}
+
+	name := ""
+	if cfg.TLS != nil {
+		tlsConfig, err := cfg.TLS.load(cfg.Addr)
+		if err != nil {
+			return "", "", err
+		}
+
+		name = fmt.Sprintf("database-%d", atomic.AddUint64(&mysqlTLSConfigs, 1))
+		if err := mysql.RegisterTLSConfig(name, tlsConfig); err != nil {
+			return "", "", err
+		}
+		c.TLSConfig = name
+	}
+
+	dsn := c.FormatDSN()
+	if len(cfg.Params) == 0 {
+		return dsn, name, nil
+	}
+
+	// parse the params so that they may override the fields above
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+
+	c, err := mysql.ParseDSN(dsn + sep + encodeParams(cfg.Params))
+	if err != nil {
+		if name != "" {
+			mysql.DeregisterTLSConfig(name)
+		}
+		return "", "", err
+	}
+	return c.FormatDSN(), name, nil
+}
+
+func (cfg Config) postgresDSN() string {
+	u := url.URL{
+		Scheme: "postgres",
+		Host:   cfg.Addr,
+		Path:   "/" + cfg.Database,
+	}
+
+	if cfg.Password != "" {
+		u.User = url.UserPassword(cfg.User, cfg.Password)
+	} else if cfg.User != "" {
+		u.User = url.User(cfg.User)
+	}
+
+	params := make(map[string]string, len(cfg.Params)+4)
+	if t := cfg.TLS; t != nil {
+		params["sslmode"] = "verify-full"
+		if t.InsecureSkipVerify {
+			params["sslmode"] = "require"
+		}
+		for k, v := range map[string]string{"sslrootcert": t.CAFile, "sslcert": t.CertFile, "sslkey": t.KeyFile} {
+			if v != "" {
+				params[k] = v
+			}
+		}
+	}
+	for k, v := range cfg.Params {
+		params[k] = v
+	}
+
+	u.RawQuery = encodeParams(params)
+	return u.String()
+}
+
+// encodeParams encodes params as a query string in key order.
+func encodeParams(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = url.QueryEscape(k) + "=" + url.QueryEscape(params[k])
+	}
+	return strings.Join(parts, "&")
+}
+
+// load returns the tls.Config of t for connections to addr.
+func (t *TLSConfig) load(addr string) (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if c.ServerName == "" {
+		c.ServerName = addr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			c.ServerName = host
+		}
+	}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %s", t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := Open(ctx, Config{
+		Dialect:         SqliteDialect{},
+		Database:        ":memory:",
+		Params:          map[string]string{"cache": "private"},
+		MaxIdleConns:    2,
+		ConnMaxLifetime: time.Minute,
+	})
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	defer db.Close()
+
+	if n, err := Scalar(db, "SELECT 1"); err != nil || n != 1 {
+		t.Fatalf("expected 1, nil got %d, %v", n, err)
+	}
+
+	if s := db.Stats(); s.MaxOpenConnections != 1 {
+		t.Fatalf("expected a single in-memory connection got %d", s.MaxOpenConnections)
+	}
+
+	if _, err := Open(ctx, Config{Addr: "localhost:3306", User: "testing"}); err != ErrMissingDSN {
+		t.Fatalf("expected %v got %v", ErrMissingDSN, err)
+	}
+
+	// nothing listens on port 1
+	start := time.Now()
+	_, err = Open(ctx, Config{
+		Addr:        "127.0.0.1:1",
+		Database:    "testing",
+		Params:      map[string]string{"timeout": "1s"},
+		PingRetries: 2,
+		PingBackoff: 10 * time.Millisecond,
+	})
+
+	// backoffs of 10ms and 20ms
+	if err == nil || time.Since(start) < 30*time.Millisecond {
+		t.Fatalf("expected a ping error after 2 retries got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestFormatDSN(t *testing.T) {
+	for _, tt := range []struct {
+		cfg  Config
+		want string
+	}{
+		{
+			Config{Addr: "db:3306", User: "app", Password: "secret", Database: "app"},
+			"app:secret@tcp(db:3306)/app?parseTime=true",
+		},
+		{
+			Config{Addr: "db:3306", User: "app", Database: "app", Params: map[string]string{"parseTime": "false", "charset": "utf8mb4"}},
+			"app@tcp(db:3306)/app?charset=utf8mb4",
+		},
+		{
+			Config{Dialect: PostgresDialect{}, Addr: "db:5432", User: "app", Password: "p@ss", Database: "app",
+				TLS: &TLSConfig{CAFile: "/etc/ca.pem"}},
+			"postgres://app:p%40ss@db:5432/app?sslmode=verify-full&sslrootcert=%2Fetc%2Fca.pem",
+		},
+		{
+			Config{Dialect: SqliteDialect{}, Database: "/tmp/app.db"},
+			"/tmp/app.db",
+		},
+	} {
+		d := tt.cfg.Dialect
+		if d == nil {
+			d = MySQLDialect{}
+		}
+
+		if got, _, err := tt.cfg.formatDSN(d); err != nil || got != tt.want {
+			t.Errorf("%+v: expected %q got %q, %v", tt.cfg, tt.want, got, err)
+		}
+	}
+
+	if _, _, err := (Config{Dialect: SqliteDialect{}, Database: "app.db", TLS: &TLSConfig{}}).formatDSN(SqliteDialect{}); err == nil {
+		t.Errorf("expected TLS error for SQLite")
+	}
+}
+
+func TestSqliteInMemory(t *testing.T) {
+	for dsn, want := range map[string]bool{
+		":memory:":                          true,
+		"file::memory:":                     true,
+		"file::memory:?cache=shared":        true,
+		"file:app?mode=memory&cache=shared": true,
+		"file:app.db?mode=rwc":              false,
+		"app.db":                            false,
+		"memory.db?mode=memory":             false,
+	} {
+		if got := sqliteInMemory(dsn); got != want {
+			t.Errorf("%s: expected %v got %v", dsn, want, got)
+		}
+	}
+}
+
+func TestOpenTLS(t *testing.T) {
+	db, err := Open(context.Background(), Config{
+		Addr:        "localhost:3306",
+		Database:    "app",
+		TLS:         &TLSConfig{InsecureSkipVerify: true},
+		PingRetries: -1,
+	})
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	dsn := "tcp(localhost:3306)/app?tls=" + db.tlsConfig
+
+	if _, err := mysql.ParseDSN(dsn); err != nil {
+		t.Fatalf("expected a registered TLS config got %v", err)
+	}
+
+	db.Close()
+
+	if _, err := mysql.ParseDSN(dsn); err == nil {
+		t.Fatalf("expected the TLS config to be deregistered on Close")
+	}
+}
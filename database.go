@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/go-sql-driver/mysql"
@@ -13,28 +14,68 @@ type NullTime struct {
 	mysql.NullTime
 }
 
-func connect(driver, dsn string) *sql.DB {
-	db, err := sql.Open(driver, dsn)
+type DB struct {
+	sqlx.DB
+	// Dialect of the database engine behind the connection.
+	Dialect Dialect
 
-	if err != nil {
-		panic("Error connecting to db: " + err.Error())
-	}
+	// MaxTxRetries is the number of times Transact re-runs its closure
+	// when the transaction fails with a deadlock or lock wait timeout.
+	MaxTxRetries int
 
-	return db
-}
+	// Observer, if not nil, is notified of every statement run by the DB
+	// and its transactions.
+	Observer QueryObserver
+
+	// Redact, if not nil, rewrites the arguments passed to Observer.
+	Redact Redactor
 
-type DB struct {
-	sqlx.DB
 	stmtCache *stmtCache
+
+	// name of the TLS config registered with the MySQL driver by Open
+	tlsConfig string
+}
+
+func newDB(sqlxDb *sqlx.DB, dialect Dialect) *DB {
+	return &DB{
+		DB:        *sqlxDb,
+		Dialect:   dialect,
+		stmtCache: newStmtCache(),
+	}
 }
 
+// NewDB connects to the MySQL database at dsn. It panics if dsn is empty
+// or invalid and does not ping the database; Open reports these errors
+// instead.
 func NewDB(dsn string) *DB {
+	return NewDBDialect(MySQLDialect{}, dsn)
+}
+
+// NewDBDialect connects to dsn using the driver of the given dialect. It
+// panics like NewDB.
+func NewDBDialect(dialect Dialect, dsn string) *DB {
 	if dsn == "" {
-		dsn = "testing:testing@tcp(localhost:3306)/testing?charset=utf8&parseTime=True"
+		panic("Error connecting to db: " + ErrMissingDSN.Error())
+	}
+
+	db, err := open(Config{Dialect: dialect, DSN: dsn})
+
+	if err != nil {
+		panic("Error connecting to db: " + err.Error())
+	}
+
+	return db
+}
+
+// NewSqliteDB opens the SQLite database stored in the file at path. An
+// empty path or ":memory:" opens a private in-memory database. The
+// caller must import a driver registered as "sqlite3".
+func NewSqliteDB(path string) (*DB, error) {
+	if path == "" {
+		path = ":memory:"
 	}
 
-	sqlxDb := sqlx.NewDb(connect("mysql", dsn), "mysql")
-	return &DB{*sqlxDb, newStmtCache()}
+	return Open(context.Background(), Config{Dialect: SqliteDialect{}, Database: path})
 }
 
 type Conn interface {
@@ -42,9 +83,13 @@ type Conn interface {
 	sqlx.Execer
 	sqlx.Preparer
 	Preparex(string) (*sqlx.Stmt, error)
+	sqlx.QueryerContext
+	sqlx.ExecerContext
+	sqlx.PreparerContext
+	PreparexContext(context.Context, string) (*sqlx.Stmt, error)
 }
 
-var _, _ Conn = &sqlx.DB{}, &sqlx.Tx{}
+var _, _, _, _ Conn = &sqlx.DB{}, &sqlx.Tx{}, &DB{}, &Tx{}
 
 func init() {
 	sqlx.NameMapper = func(v string) string { return v }
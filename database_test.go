@@ -1,10 +1,15 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
 )
 
 var regOnce sync.Once
@@ -13,6 +18,7 @@ var dbMap *DbMap
 func registerTables() {
 	dbMap = DefaultDBMap
 	dbMap.AddTableWithName(Friend{}, "Friend").SetKeys(true, "FriendID")
+	dbMap.AddTableWithName(Note{}, "Note").SetKeys(true, "NoteID").SetVersionCol("Version")
 }
 
 func init() {
@@ -46,7 +52,99 @@ func TestDatabase(t *testing.T) {
 		t.Fatalf("expected nil got %v", err)
 	}
 
-	ast.Equal(1, f.FriendID)
+	if f.FriendID != 1 {
+		t.Fatalf("expected 1 got %d", f.FriendID)
+	}
+
+	f.Name = "Bar"
+	err = friendPut(db, f)
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	var friends []Friend
+	err = Select(db, &friends, "SELECT * FROM Friend")
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if len(friends) != 1 || friends[0] != *f {
+		t.Fatalf("expected [%v] got %v", *f, friends)
+	}
+
+	n, err := Delete(db, f)
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if n != 1 {
+		t.Fatalf("expected 1 got %d", n)
+	}
+}
+
+type Note struct {
+	NoteID  int64
+	Body    string
+	Version int64
+}
+
+func TestOptimisticLock(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	n := &Note{Body: "Foo", Version: 7}
+
+	if err := Insert(db, n); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if n.Version != 1 {
+		t.Fatalf("expected 1 got %d", n.Version)
+	}
+
+	stale := *n
+	n.Body = "Bar"
+
+	if _, err := Update(db, n); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if n.Version != 2 {
+		t.Fatalf("expected 2 got %d", n.Version)
+	}
+
+	stale.Body = "Baz"
+	_, err := Update(db, &stale)
+	lockErr, ok := err.(*OptimisticLockError)
+
+	if !ok {
+		t.Fatalf("expected *OptimisticLockError got %v", err)
+	}
+
+	if lockErr.TableName != "Note" || lockErr.LocalVersion != 1 || lockErr.Keys[0] != n.NoteID {
+		t.Fatalf("unexpected %+v", lockErr)
+	}
+}
+
+func TestContextCanceled(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := InsertContext(ctx, db, &Friend{Name: "Foo"}); err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+
+	if _, err := ScalarContext(ctx, db, "SELECT COUNT(*) FROM Friend"); err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
 }
 
 func friendCount(conn Conn) (int64, error) {
@@ -64,7 +162,20 @@ func friendPut(conn Conn, f *Friend) (err error) {
 	return
 }
 
+// dbFromConf returns an in-memory SQLite database unless TEST_MYSQL is
+// set, in which case the MySQL server on localhost is used.
 func dbFromConf(t *testing.T) *DB {
+	if os.Getenv("TEST_MYSQL") == "" && os.Getenv("TRAVIS") != "true" {
+		db, err := NewSqliteDB(":memory:")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dbMap.SetDialect(db.Dialect)
+		return db
+	}
+
 	dbname := "testing"
 	dsn := fmt.Sprintf("testing:testing@tcp(localhost:3306)/%s?charset=utf8&parseTime=True", dbname)
 
@@ -79,24 +190,421 @@ func dbFromConf(t *testing.T) *DB {
 		t.Fatal(err)
 	}
 
+	dbMap.SetDialect(db.Dialect)
 	return db
 }
 
 func setUp(t *testing.T, conn Conn) {
-	createFriend := `CREATE TABLE IF NOT EXISTS Friend (
-		FriendID	INT(11)			UNSIGNED NOT NULL AUTO_INCREMENT,
-		Name		VARCHAR(255)	NULL DEFAULT '',
-
-		CONSTRAINT Pk_PaymentLog PRIMARY KEY (FriendID)
-	) ENGINE=InnoDB CHARSET=utf8 COLLATE=utf8_unicode_ci`
-
-	if _, err := Exec(conn, createFriend); err != nil {
+	if err := dbMap.CreateTablesIfNotExists(conn); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func tearDown(t *testing.T, conn Conn) {
-	if _, err := Exec(conn, "DROP TABLE Friend"); err != nil {
+	if err := dbMap.DropTables(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type Membership struct {
+	GroupID  int64
+	FriendID int64
+	Role     string
+	Note     string
+	Cached   int
+}
+
+func TestCreateTableSql(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		friend  string
+		member  string
+	}{
+		{
+			MySQLDialect{Engine: "InnoDB", Charset: "utf8"},
+			"CREATE TABLE IF NOT EXISTS `Friend` (`FriendID` int NOT NULL PRIMARY KEY auto_increment, `Name` varchar(255)) engine=InnoDB charset=utf8;",
+			"CREATE TABLE `Membership` (`GroupID` bigint NOT NULL, `FriendID` bigint NOT NULL, `Role` varchar(32) UNIQUE, `Note` text, PRIMARY KEY (`GroupID`, `FriendID`)) engine=InnoDB charset=utf8;",
+		},
+		{
+			PostgresDialect{},
+			`CREATE TABLE IF NOT EXISTS "Friend" ("FriendID" serial NOT NULL PRIMARY KEY, "Name" text);`,
+			`CREATE TABLE "Membership" ("GroupID" bigint NOT NULL, "FriendID" bigint NOT NULL, "Role" varchar(32) UNIQUE, "Note" text, PRIMARY KEY ("GroupID", "FriendID"));`,
+		},
+		{
+			SqliteDialect{},
+			`CREATE TABLE IF NOT EXISTS "Friend" ("FriendID" integer NOT NULL PRIMARY KEY autoincrement, "Name" text);`,
+			`CREATE TABLE "Membership" ("GroupID" integer NOT NULL, "FriendID" integer NOT NULL, "Role" varchar(32) UNIQUE, "Note" text, PRIMARY KEY ("GroupID", "FriendID"));`,
+		},
+	}
+
+	for _, tt := range tests {
+		m := NewDbMap(tt.dialect)
+		m.AddTableWithName(Friend{}, "Friend").SetKeys(true, "FriendID")
+		tm := m.AddTable(Membership{}).SetKeys(false, "GroupID", "FriendID")
+		tm.ColMap("Role").SetMaxSize(32).SetUnique(true)
+		tm.ColMap("Note").SetSqlType("text")
+		tm.ColMap("Cached").SetTransient(true)
+
+		if got := m.TableFor(Friend{}).createTableSql(true); got != tt.friend {
+			t.Errorf("%T: expected %s got %s", tt.dialect, tt.friend, got)
+		}
+
+		if got := tm.createTableSql(false); got != tt.member {
+			t.Errorf("%T: expected %s got %s", tt.dialect, tt.member, got)
+		}
+	}
+}
+
+func TestConnDialect(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	var queries []string
+	db.Observer = QueryObserverFunc(func(ctx context.Context, e *QueryEvent) {
+		queries = append(queries, e.Query)
+	})
+	defer func() { db.Observer = nil }()
+
+	// the statements of a DbMap of another dialect follow the dialect of db
+	m := NewDbMap(PostgresDialect{})
+	table := m.AddTableWithName(Friend{}, "Friend").SetKeys(true, "FriendID")
+	m.AddTableWithName(Account{}, "Account").SetKeys(true, "AccountID").ColMap("Email").SetUnique(true)
+
+	ctx := context.Background()
+	f := &Friend{Name: "a"}
+
+	if err := queryInsert(ctx, m, db, f); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if err := queryGet(ctx, m, db, f, f.FriendID); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	f.Name = "b"
+
+	if _, err := queryUpdate(ctx, m, db, f); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if err := queryInsertBatch(ctx, m, db, []*Friend{{Name: "c"}, {Name: "d"}}); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if _, err := queryUpsert(ctx, m, db, UpsertOptions{ConflictColumns: []string{"Email"}}, &Account{Email: "a@example.com"}); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	var friends []*Friend
+	p := &Paginator{Table: table, Sort: []SortColumn{{Column: "FriendID"}}, Limit: 2, Secret: []byte("secret")}
+	page, err := p.Page(db, table.Query().In("Name", []string{"b", "c", "d"}), "", &friends)
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	friends = nil
+	if _, err := p.Page(db, table.Query(), page.Next, &friends); err != nil || len(friends) != 1 {
+		t.Fatalf("expected 1, nil got %d, %v", len(friends), err)
+	}
+
+	if _, err := queryDelete(ctx, m, db, f); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	quoted := db.Dialect.QuoteField("Friend")
+
+	for _, q := range queries {
+		if strings.Contains(q, "$1") || strings.Contains(q, "DEFAULT") {
+			t.Errorf("unexpected Postgres statement %s", q)
+		}
+		if strings.Contains(q, "Friend") && !strings.Contains(q, quoted) {
+			t.Errorf("expected %s in %s", quoted, q)
+		}
+	}
+}
+
+func TestSelectBuilderConnDialect(t *testing.T) {
+	b := NewDbMap(MySQLDialect{}).QueryTable("Friend").In("f.FriendID", []int{1})
+
+	query, _, err := b.toSql(PostgresDialect{})
+	want := `SELECT * FROM "Friend" WHERE ("f"."FriendID" IN ($1))`
+
+	if err != nil || query != want {
+		t.Fatalf("expected %s got %s, %v", want, query, err)
+	}
+}
+
+func TestAddTableRename(t *testing.T) {
+	m := NewDbMap(MySQLDialect{})
+	table := m.AddTableWithName(Friend{}, "Friend").SetKeys(true, "FriendID")
+	elem := reflect.ValueOf(&Friend{Name: "a"}).Elem()
+	table.bindInsert(elem)
+	table.bindGet()
+
+	if m.AddTableWithName(Friend{}, "Buddy") != table {
+		t.Fatalf("expected the existing table")
+	}
+
+	for _, query := range []string{table.bindInsert(elem).query, table.bindGet().query, table.ColumnsStr()} {
+		if !strings.Contains(query, "`Buddy`") || strings.Contains(query, "`Friend`") {
+			t.Errorf("expected the new name in %s", query)
+		}
+	}
+}
+
+func TestTableMapConcurrentFirstUse(t *testing.T) {
+	table := NewDbMap(MySQLDialect{}).AddTableWithName(Note{}, "Note").SetKeys(true, "NoteID").SetVersionCol("Version")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			elem := reflect.ValueOf(&Note{Body: "a"}).Elem()
+			table.bindInsert(elem)
+			table.bindInsertBatch([]reflect.Value{elem, elem})
+			table.bindUpdate(elem)
+			table.bindUpdateColumns(elem, []*ColumnMap{table.ColMap("Body")})
+			table.bindDelete(elem)
+			table.bindGet()
+			table.ColumnsStr()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGet(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	f := &Friend{Name: "Foo"}
+
+	if err := Insert(db, f); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	var got Friend
+
+	if err := Get(db, &got, f.FriendID); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if got != *f {
+		t.Fatalf("expected %v got %v", *f, got)
+	}
+
+	if err := Get(db, &got, f.FriendID+1); err != ErrNoRows {
+		t.Fatalf("expected %v got %v", ErrNoRows, err)
+	}
+
+	if err := Get(db, &got, 1, 2); err == nil {
+		t.Fatalf("expected key count error")
+	}
+
+	m := NewDbMap(db.Dialect)
+	m.AddTable(Membership{}).SetKeys(false, "GroupID", "FriendID")
+
+	if err := m.CreateTables(db); err != nil {
 		t.Fatal(err)
 	}
+	defer m.DropTables(db)
+
+	q := "INSERT INTO Membership (GroupID, FriendID, Role, Note, Cached) VALUES (1, 2, 'admin', '', 0), (1, 3, 'member', '', 0)"
+	if _, err := Exec(db, q); err != nil {
+		t.Fatal(err)
+	}
+
+	var ms Membership
+
+	if err := m.Get(db, &ms, 1, 3); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if ms.Role != "member" {
+		t.Fatalf("expected member got %s", ms.Role)
+	}
+}
+
+func TestUpdateColumns(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	a := &Account{Email: "a@example.com", Name: "A"}
+
+	if err := Insert(db, a); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	a.Email = "b@example.com"
+	a.Name = "B"
+
+	if n, err := UpdateColumns(db, a, "Name"); err != nil || n != 1 {
+		t.Fatalf("expected 1, nil got %d, %v", n, err)
+	}
+
+	var got Account
+
+	if err := Get(db, &got, a.AccountID); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if got.Email != "a@example.com" || got.Name != "B" {
+		t.Fatalf("unexpected %+v", got)
+	}
+
+	a.Name = "C"
+
+	if _, err := UpdateColumnsExcept(db, a, "name"); err == nil {
+		t.Fatalf("expected unknown column error")
+	}
+
+	if _, err := UpdateColumnsExcept(db, a, "Name"); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if err := Get(db, &got, a.AccountID); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if got.Email != "b@example.com" || got.Name != "B" {
+		t.Fatalf("unexpected %+v", got)
+	}
+
+	if _, err := UpdateColumns(db, a, "AccountID"); err == nil {
+		t.Fatalf("expected key column error")
+	}
+
+	n := &Note{Body: "a"}
+
+	if err := Insert(db, n); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	n.Body = "b"
+
+	if _, err := UpdateColumns(db, n, "Body"); err != nil || n.Version != 2 {
+		t.Fatalf("expected version 2, nil got %d, %v", n.Version, err)
+	}
+}
+
+type Timestamps struct {
+	Created int64
+	Updated int64
+}
+
+type Audit struct {
+	Author string
+}
+
+type Ignored struct {
+	Secret string
+}
+
+type Post struct {
+	PostID int
+	Title  string
+	Timestamps
+	*Audit
+	Ignored `db:"-"`
+}
+
+func init() {
+	DefaultDBMap.AddTableWithName(Post{}, "Post").SetKeys(true, "PostID")
+}
+
+func TestEmbeddedStruct(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	var names []string
+	for _, col := range DefaultDBMap.TableFor(Post{}).columns {
+		names = append(names, col.ColumnName)
+	}
+
+	if got := strings.Join(names, ","); got != "PostID,Title,Created,Updated,Author" {
+		t.Fatalf("unexpected columns %s", got)
+	}
+
+	// a nil embedded pointer inserts zero values
+	p := &Post{Title: "a", Timestamps: Timestamps{Created: 1}}
+
+	if err := Insert(db, p); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	p.Audit = &Audit{Author: "b"}
+	p.Updated = 2
+
+	if n, err := Update(db, p); err != nil || n != 1 {
+		t.Fatalf("expected 1, nil got %d, %v", n, err)
+	}
+
+	var got Post
+
+	if err := Get(db, &got, p.PostID); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if got.Created != 1 || got.Updated != 2 || got.Audit == nil || got.Author != "b" {
+		t.Fatalf("unexpected %+v", got)
+	}
+}
+
+type Subscriber struct {
+	ID      int64  `db:"id,autoincr"`
+	Email   string `db:"email,unique,size:255"`
+	Created int64  `db:"created,readonly,type:INTEGER NOT NULL DEFAULT 7"`
+	Payload string `db:"payload,type:TEXT"`
+}
+
+func (Subscriber) TableName() string {
+	return "subscribers"
+}
+
+func init() {
+	DefaultDBMap.AddTable(Subscriber{})
+}
+
+func TestTagOptions(t *testing.T) {
+	table := NewDbMap(SqliteDialect{}).AddTable(Subscriber{})
+
+	want := `CREATE TABLE "subscribers" ("id" integer NOT NULL PRIMARY KEY autoincrement, "email" varchar(255) UNIQUE, "created" INTEGER NOT NULL DEFAULT 7, "payload" TEXT);`
+	if got := table.createTableSql(false); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	s := &Subscriber{Email: "a@example.com", Created: 1}
+
+	if err := Insert(db, s); err != nil || s.ID == 0 {
+		t.Fatalf("expected nil and an id got %v, %d", err, s.ID)
+	}
+
+	if n, err := Update(db, s); err != nil || n != 1 {
+		t.Fatalf("expected 1, nil got %d, %v", n, err)
+	}
+
+	var got Subscriber
+
+	if err := Get(db, &got, s.ID); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	// read-only columns are left to the database
+	if got.Created != 7 || got.Email != s.Email {
+		t.Fatalf("unexpected %+v", got)
+	}
+
+	if _, err := UpdateColumns(db, &got, "created"); err == nil {
+		t.Fatalf("expected error updating read-only column")
+	}
 }
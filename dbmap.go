@@ -1,8 +1,14 @@
 package database
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -26,11 +32,123 @@ func tableForPointer(m *DbMap, i interface{}, checkPk bool) (*TableMap, reflect.
 }
 
 type DbMap struct {
-	tables []*TableMap
+	// Dialect used to generate SQL for the registered tables. A nil
+	// Dialect defaults to MySQLDialect.
+	Dialect Dialect
+	tables  []*TableMap
+
+	// copies of the DbMap for the dialects of other connections
+	mu          sync.Mutex
+	dialectMaps []*DbMap
+}
+
+// NewDbMap returns an empty DbMap generating SQL for dialect.
+func NewDbMap(dialect Dialect) *DbMap {
+	return &DbMap{Dialect: dialect}
+}
+
+func (m *DbMap) dialect() Dialect {
+	if m.Dialect == nil {
+		return MySQLDialect{}
+	}
+	return m.Dialect
+}
+
+// SetDialect changes the dialect of the DbMap and resets the cached SQL
+// of all registered tables.
+func (m *DbMap) SetDialect(dialect Dialect) *DbMap {
+	m.Dialect = dialect
+	for _, t := range m.tables {
+		t.ResetSql()
+	}
+	return m
+}
+
+// forConn returns m, or a copy of m generating SQL for the dialect of
+// conn if it is a *DB or *Tx of another dialect. The copies share the
+// columns of the tables of m but cache their own SQL, and are dropped
+// when the tables of m change.
+func (m *DbMap) forConn(conn Conn) *DbMap {
+	d := connDialect(m, conn)
+	if sameDialect(d, m.dialect()) {
+		return m
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, dm := range m.dialectMaps {
+		if sameDialect(d, dm.Dialect) {
+			return dm
+		}
+	}
+
+	dm := &DbMap{Dialect: d, tables: make([]*TableMap, len(m.tables))}
+	for i, t := range m.tables {
+		dm.tables[i] = &TableMap{
+			TableName:     t.TableName,
+			gotype:        t.gotype,
+			columns:       t.columns,
+			keys:          t.keys,
+			version:       t.version,
+			snapshotIndex: t.snapshotIndex,
+			dbmap:         dm,
+		}
+	}
+	m.dialectMaps = append(m.dialectMaps, dm)
+	return dm
+}
+
+// resetDialectMaps drops the copies of m made by forConn.
+func (m *DbMap) resetDialectMaps() {
+	m.mu.Lock()
+	m.dialectMaps = nil
+	m.mu.Unlock()
+}
+
+// sameDialect reports whether a and b generate the same SQL. Dialects
+// of a type that cannot be compared are the same if their types are.
+func sameDialect(a, b Dialect) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	return !reflect.TypeOf(a).Comparable() || a == b
+}
+
+// PrepareIN returns n comma separated bind variables, numbered from
+// start, suitable for an IN (...) clause.
+func (m *DbMap) PrepareIN(start, n int) string {
+	d := m.dialect()
+	s := bytes.Buffer{}
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(d.BindVar(start + i))
+	}
+	return s.String()
 }
 
 // AddTable registers the given interface type with modl. The table name
-// will be given the name of the TypeOf(i), lowercased.
+// is taken from the TableName method of the type if it has one, and is
+// the name of the TypeOf(i) otherwise.
+//
+// The db tag of a field names its column and may list options after the
+// name, separated by commas:
+//
+//	pk        the column is part of the primary key
+//	autoincr  the column is an auto-increment primary key
+//	unique    see ColumnMap.Unique
+//	readonly  see ColumnMap.ReadOnly
+//	size:N    see ColumnMap.MaxSize
+//	type:T    the column type used by CreateTables, e.g. type:JSON
+//
+// For example `db:"id,pk,autoincr"` or `db:",unique,size:255"`, where an
+// empty name keeps the field name. AddTable panics on unknown options.
+//
+// Fields of embedded structs, or pointers to structs, without a db tag
+// are mapped as columns of the table, following Go's rules for promoted
+// fields. Embeds tagged `db:"-"` are skipped.
 //
 // This operation is idempotent. If i's type is already mapped, the
 // existing *TableMap is returned
@@ -42,7 +160,11 @@ func (m *DbMap) AddTable(i interface{}, name ...string) *TableMap {
 
 	t := reflect.TypeOf(i)
 	if len(Name) == 0 {
-		Name = sqlx.NameMapper(t.Name())
+		if n, ok := reflect.New(t).Interface().(tableNamer); ok {
+			Name = n.TableName()
+		} else {
+			Name = sqlx.NameMapper(t.Name())
+		}
 	}
 
 	// check if we have a table for this type already
@@ -50,31 +172,24 @@ func (m *DbMap) AddTable(i interface{}, name ...string) *TableMap {
 	for i := range m.tables {
 		table := m.tables[i]
 		if table.gotype == t {
-			table.TableName = Name
+			if table.TableName != Name {
+				table.TableName = Name
+				table.ResetSql()
+			}
 			return table
 		}
 	}
 
 	tmap := &TableMap{gotype: t, TableName: Name, dbmap: m}
 
-	n := t.NumField()
-	tmap.columns = make([]*ColumnMap, 0, n)
-	for i := 0; i < n; i++ {
-		f := t.Field(i)
-		columnName := f.Tag.Get("db")
-		if columnName == "" {
-			columnName = sqlx.NameMapper(f.Name)
-		}
-
-		cm := &ColumnMap{
-			ColumnName: columnName,
-			Transient:  columnName == "-",
-			fieldName:  f.Name,
-			gotype:     f.Type,
+	tmap.addColumns(t, nil)
+	for _, col := range tmap.columns {
+		if col.isPK {
+			tmap.keys = append(tmap.keys, col)
 		}
-		tmap.columns = append(tmap.columns, cm)
 	}
 	m.tables = append(m.tables, tmap)
+	m.resetDialectMaps()
 	return tmap
 }
 
@@ -82,6 +197,66 @@ func (m *DbMap) AddTableWithName(i interface{}, name string) *TableMap {
 	return m.AddTable(i, name)
 }
 
+// Get loads the row with the given primary key values into dest, a
+// pointer to a struct registered with this DbMap. See the package level
+// Get.
+func (m *DbMap) Get(exec Conn, dest interface{}, keys ...interface{}) error {
+	return m.GetContext(context.Background(), exec, dest, keys...)
+}
+
+func (m *DbMap) GetContext(ctx context.Context, exec Conn, dest interface{}, keys ...interface{}) error {
+	return queryGet(ctx, m, exec, dest, keys...)
+}
+
+// CreateTables iterates through TableMaps registered to this DbMap and
+// executes "create table" statements against the database for each.
+func (m *DbMap) CreateTables(conn Conn) error {
+	return m.createTables(conn, false)
+}
+
+// CreateTablesIfNotExists is similar to CreateTables, but starts each
+// statement with "create table if not exists" so that existing tables
+// do not raise errors.
+func (m *DbMap) CreateTablesIfNotExists(conn Conn) error {
+	return m.createTables(conn, true)
+}
+
+func (m *DbMap) createTables(conn Conn, ifNotExists bool) error {
+	m = m.forConn(conn)
+	for _, table := range m.tables {
+		if _, err := conn.Exec(table.createTableSql(ifNotExists)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropTables drops all tables registered to this DbMap, in the reverse
+// order of registration.
+func (m *DbMap) DropTables(conn Conn) error {
+	d := connDialect(m, conn)
+	for i := len(m.tables) - 1; i >= 0; i-- {
+		q := "DROP TABLE " + d.QuoteField(m.tables[i].TableName) + ";"
+		if _, err := conn.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TruncateTables removes all rows from the tables registered to this
+// DbMap, in the reverse order of registration.
+func (m *DbMap) TruncateTables(conn Conn) error {
+	d := connDialect(m, conn)
+	for i := len(m.tables) - 1; i >= 0; i-- {
+		q := d.TruncateClause() + " " + d.QuoteField(m.tables[i].TableName) + ";"
+		if _, err := conn.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Returns any matching tables for the interface i or nil if not found
 // If i is a slice, then the table is given for the base slice type
 func (m *DbMap) TableFor(i interface{}) *TableMap {
@@ -95,8 +270,11 @@ start:
 		v = v.Elem()
 		goto start
 	case reflect.Slice:
-		// if this is a slice of X's, we're interested in the type of X
+		// if this is a slice of X's or *X's, we're interested in the type of X
 		t = v.Type().Elem()
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
 	default:
 		t = v.Type()
 	}
@@ -116,5 +294,134 @@ func (m *DbMap) TableForType(t reflect.Type) *TableMap {
 var DefaultDBMap *DbMap
 
 func init() {
-	DefaultDBMap = &DbMap{}
+	DefaultDBMap = NewDbMap(MySQLDialect{})
+}
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+// addColumns maps the fields of the struct type st, found at index within
+// the table's type, flattening embedded structs.
+func (t *TableMap) addColumns(st reflect.Type, index []int) {
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		fi := append(index[:len(index):len(index)], i)
+
+		if f.Type == snapshotType {
+			t.snapshotIndex = fi
+			continue
+		}
+
+		tag := f.Tag.Get("db")
+		columnName, opts := parseTag(tag)
+
+		if f.Anonymous {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if columnName == "-" {
+				continue
+			}
+			if tag == "" && ft.Kind() == reflect.Struct && !reflect.PtrTo(ft).Implements(scannerType) {
+				t.addColumns(ft, fi)
+				continue
+			}
+		} else if f.PkgPath != "" {
+			continue
+		}
+
+		if columnName == "" {
+			columnName = sqlx.NameMapper(f.Name)
+		}
+
+		cm := &ColumnMap{
+			ColumnName: columnName,
+			Transient:  columnName == "-",
+			fieldName:  f.Name,
+			fieldIndex: fi,
+			gotype:     f.Type,
+		}
+
+		if err := cm.setOptions(opts); err != nil {
+			panic(fmt.Sprintf("Field %s of table %s: %v", f.Name, t.TableName, err))
+		}
+
+		// a field shadows the fields of the same name embedded deeper
+		if prev := t.columnNamed(columnName); prev != nil {
+			if len(prev.fieldIndex) > len(fi) {
+				*prev = *cm
+			}
+			continue
+		}
+		t.columns = append(t.columns, cm)
+	}
+}
+
+func (t *TableMap) columnNamed(name string) *ColumnMap {
+	if name == "-" {
+		return nil
+	}
+	for _, col := range t.columns {
+		if col.ColumnName == name {
+			return col
+		}
+	}
+	return nil
+}
+
+// tableNamer is implemented by structs that name their own table.
+type tableNamer interface {
+	TableName() string
+}
+
+// parseTag splits a db tag into the column name and its options. Commas
+// inside parentheses, as in type:DECIMAL(10,2), do not split options.
+func parseTag(tag string) (string, []string) {
+	parts := strings.Split(tag, ",")
+	opts := make([]string, 0, len(parts)-1)
+
+	for i := 1; i < len(parts); i++ {
+		n := len(opts)
+		if n > 0 && strings.Count(opts[n-1], "(") > strings.Count(opts[n-1], ")") {
+			opts[n-1] += "," + parts[i]
+			continue
+		}
+		opts = append(opts, strings.TrimSpace(parts[i]))
+	}
+	return parts[0], opts
+}
+
+func (c *ColumnMap) setOptions(opts []string) error {
+	for _, opt := range opts {
+		key, val := opt, ""
+		if i := strings.IndexByte(opt, ':'); i >= 0 {
+			key, val = opt[:i], opt[i+1:]
+		}
+
+		switch key {
+		case "pk":
+			c.isPK = true
+		case "autoincr":
+			c.isPK = true
+			c.isAutoIncr = true
+		case "unique":
+			c.Unique = true
+		case "readonly":
+			c.ReadOnly = true
+		case "size":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("Invalid size %q", val)
+			}
+			c.MaxSize = n
+		case "type":
+			if val == "" {
+				return fmt.Errorf("Empty type option")
+			}
+			c.sqltype = val
+		default:
+			return fmt.Errorf("Unknown db tag option %q", opt)
+		}
+	}
+	return nil
 }
@@ -1,16 +1,504 @@
 package database
 
-import "fmt"
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Dialect encapsulates the differences between database engines. All SQL
+// generated by a TableMap goes through the Dialect of the DbMap it is
+// registered with.
+type Dialect interface {
+	// DriverName returns the database/sql driver name used by Open.
+	DriverName() string
+
+	// BindVar returns the bind variable for the i'th (0-based) argument
+	// of a statement.
+	BindVar(i int) string
+
+	// QuoteField quotes a table or column identifier.
+	QuoteField(field string) string
+
+	// AutoIncrBindValue returns the value written for an auto-increment
+	// column in an INSERT statement.
+	AutoIncrBindValue() string
+
+	// AutoIncrInsertSuffix returns the clause appended to an INSERT
+	// statement for a table with the auto-increment column col.
+	AutoIncrInsertSuffix(col *ColumnMap) string
+
+	// InsertAutoIncr runs an INSERT statement and returns the value
+	// generated for the auto-increment column.
+	InsertAutoIncr(ctx context.Context, exec Conn, query string, args ...interface{}) (int64, error)
+
+	// InsertAutoIncrBatch runs a multi-row INSERT statement of n rows and
+	// returns the values generated for the auto-increment column in row
+	// order.
+	InsertAutoIncrBatch(ctx context.Context, exec Conn, query string, n int, args ...interface{}) ([]int64, error)
+
+	// MaxBindVars returns the maximum number of bind variables in a
+	// single statement.
+	MaxBindVars() int
+
+	// ToSqlType returns the column type used by CreateTables.
+	ToSqlType(col *ColumnMap) string
+
+	// AutoIncrStr returns the column constraint appended after the
+	// primary key of an auto-increment column.
+	AutoIncrStr() string
+
+	// CreateTableSuffix returns the table options appended to CREATE
+	// TABLE statements.
+	CreateTableSuffix() string
+
+	// TruncateClause returns the statement, without the table name, used
+	// to remove all rows of a table.
+	TruncateClause() string
+}
+
+// sqlBaseType dereferences pointer types so that *T maps to the same
+// column type as T.
+func sqlBaseType(col *ColumnMap) reflect.Type {
+	t := col.gotype
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// MySQLDialect implements Dialect for MySQL and MariaDB. Engine, Charset
+// and Collation are used as table options by CreateTables and are
+// omitted when empty.
+type MySQLDialect struct {
+	Engine    string
+	Charset   string
+	Collation string
+}
+
+func (d MySQLDialect) DriverName() string {
+	return "mysql"
+}
 
 // Returns "?"
-func BindVar(i int) string {
+func (d MySQLDialect) BindVar(i int) string {
 	return "?"
 }
 
-func QuoteField(f string) string {
+func (d MySQLDialect) QuoteField(f string) string {
 	return "`" + f + "`"
 }
 
+func (d MySQLDialect) AutoIncrBindValue() string {
+	return "NULL"
+}
+
+func (d MySQLDialect) AutoIncrInsertSuffix(col *ColumnMap) string {
+	return ""
+}
+
+func (d MySQLDialect) InsertAutoIncr(ctx context.Context, exec Conn, query string, args ...interface{}) (int64, error) {
+	return insertLastInsertId(ctx, exec, query, args...)
+}
+
+func (d MySQLDialect) ToSqlType(col *ColumnMap) string {
+	if col.sqltype != "" {
+		return col.sqltype
+	}
+
+	t := sqlBaseType(col)
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int8:
+		return "tinyint"
+	case reflect.Int16:
+		return "smallint"
+	case reflect.Int, reflect.Int32:
+		return "int"
+	case reflect.Int64:
+		return "bigint"
+	case reflect.Uint8, reflect.Uint16, reflect.Uint, reflect.Uint32:
+		return "int unsigned"
+	case reflect.Uint64:
+		return "bigint unsigned"
+	case reflect.Float32, reflect.Float64:
+		return "double"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "mediumblob"
+		}
+	}
+
+	switch t.Name() {
+	case "NullInt64":
+		return "bigint"
+	case "NullFloat64":
+		return "double"
+	case "NullBool":
+		return "tinyint"
+	case "Time", "NullTime":
+		return "datetime"
+	}
+
+	maxsize := col.MaxSize
+	if maxsize < 1 {
+		maxsize = 255
+	}
+	return fmt.Sprintf("varchar(%d)", maxsize)
+}
+
+func (d MySQLDialect) AutoIncrStr() string {
+	return "auto_increment"
+}
+
+func (d MySQLDialect) CreateTableSuffix() string {
+	s := ""
+	if d.Engine != "" {
+		s += " engine=" + d.Engine
+	}
+	if d.Charset != "" {
+		s += " charset=" + d.Charset
+	}
+	if d.Collation != "" {
+		s += " collate=" + d.Collation
+	}
+	return s
+}
+
+func (d MySQLDialect) TruncateClause() string {
+	return "truncate"
+}
+
+// MySQL returns the id of the first row of a multi-row INSERT, and the
+// following rows are spaced by auto_increment_increment. With
+// innodb_autoinc_lock_mode 2, the default since MySQL 8.0, the ids of a
+// statement may interleave with those of concurrent inserts into the same
+// table; use mode 0 or 1 to batch insert while other inserts run.
+func (d MySQLDialect) InsertAutoIncrBatch(ctx context.Context, exec Conn, query string, n int, args ...interface{}) ([]int64, error) {
+	step, err := mysqlAutoIncrStep(ctx, exec)
+
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := insertLastInsertId(ctx, exec, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return autoIncrIds(first, n, step), nil
+}
+
+func (d MySQLDialect) MaxBindVars() int {
+	return 65535
+}
+
+// autoIncrIds returns the n ids from first spaced by step.
+func autoIncrIds(first int64, n int, step int64) []int64 {
+	ids := make([]int64, n)
+	for i := range ids {
+		ids[i] = first + int64(i)*step
+	}
+	return ids
+}
+
+// mysqlAutoIncrSteps caches auto_increment_increment by connection pool.
+var mysqlAutoIncrSteps sync.Map
+
+// mysqlAutoIncrStep returns the auto_increment_increment of exec. It is
+// read once per pool of a *DB, *Tx or *sqlx.DB, as it is normally set for
+// the whole server, and on every call for other connections.
+func mysqlAutoIncrStep(ctx context.Context, exec Conn) (int64, error) {
+	var pool *sql.DB
+	switch c := exec.(type) {
+	case *DB:
+		pool = c.DB.DB
+	case *Tx:
+		if c.db != nil {
+			pool = c.db.DB.DB
+		}
+	case *sqlx.DB:
+		pool = c.DB
+	}
+
+	if pool != nil {
+		if step, ok := mysqlAutoIncrSteps.Load(pool); ok {
+			return step.(int64), nil
+		}
+	}
+
+	var step int64
+	if err := exec.QueryRowxContext(ctx, "SELECT @@auto_increment_increment").Scan(&step); err != nil {
+		return 0, err
+	}
+
+	if pool != nil {
+		mysqlAutoIncrSteps.Store(pool, step)
+	}
+	return step, nil
+}
+
+func insertLastInsertId(ctx context.Context, exec Conn, query string, args ...interface{}) (int64, error) {
+	res, err := exec.ExecContext(ctx, query, args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+// PostgresDialect implements Dialect for PostgreSQL. The generated id of
+// auto-increment tables is read back with INSERT ... RETURNING since
+// the postgres drivers do not support LastInsertId.
+type PostgresDialect struct{}
+
+func (d PostgresDialect) DriverName() string {
+	return "postgres"
+}
+
+// Returns "$1", "$2", ...
+func (d PostgresDialect) BindVar(i int) string {
+	return "$" + strconv.Itoa(i+1)
+}
+
+func (d PostgresDialect) QuoteField(f string) string {
+	return `"` + strings.Replace(f, `"`, `""`, -1) + `"`
+}
+
+func (d PostgresDialect) AutoIncrBindValue() string {
+	return "DEFAULT"
+}
+
+func (d PostgresDialect) AutoIncrInsertSuffix(col *ColumnMap) string {
+	return " RETURNING " + d.QuoteField(col.ColumnName)
+}
+
+func (d PostgresDialect) InsertAutoIncr(ctx context.Context, exec Conn, query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := exec.QueryRowxContext(ctx, query, args...).Scan(&id)
+	return id, err
+}
+
+func (d PostgresDialect) InsertAutoIncrBatch(ctx context.Context, exec Conn, query string, n int, args ...interface{}) ([]int64, error) {
+	rows, err := exec.QueryxContext(ctx, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	ids := make([]int64, 0, n)
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ids) != n {
+		return nil, fmt.Errorf("INSERT returned %d ids for %d rows", len(ids), n)
+	}
+	return ids, nil
+}
+
+func (d PostgresDialect) MaxBindVars() int {
+	return 65535
+}
+
+// ToSqlType maps auto-increment integer columns to serial types, which
+// supply the sequence default used by INSERT ... RETURNING.
+func (d PostgresDialect) ToSqlType(col *ColumnMap) string {
+	if col.sqltype != "" {
+		return col.sqltype
+	}
+
+	t := sqlBaseType(col)
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int8, reflect.Int16, reflect.Uint8:
+		if col.isAutoIncr {
+			return "smallserial"
+		}
+		return "smallint"
+	case reflect.Int, reflect.Int32, reflect.Uint16:
+		if col.isAutoIncr {
+			return "serial"
+		}
+		return "integer"
+	case reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		if col.isAutoIncr {
+			return "bigserial"
+		}
+		return "bigint"
+	case reflect.Float32:
+		return "real"
+	case reflect.Float64:
+		return "double precision"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytea"
+		}
+	}
+
+	switch t.Name() {
+	case "NullInt64":
+		return "bigint"
+	case "NullFloat64":
+		return "double precision"
+	case "NullBool":
+		return "boolean"
+	case "Time", "NullTime":
+		return "timestamp with time zone"
+	}
+
+	if col.MaxSize > 0 {
+		return fmt.Sprintf("varchar(%d)", col.MaxSize)
+	}
+	return "text"
+}
+
+// Returns "", serial columns need no extra constraint.
+func (d PostgresDialect) AutoIncrStr() string {
+	return ""
+}
+
+func (d PostgresDialect) CreateTableSuffix() string {
+	return ""
+}
+
+func (d PostgresDialect) TruncateClause() string {
+	return "truncate"
+}
+
+// SqliteDialect implements Dialect for SQLite. It expects a driver
+// registered as "sqlite3", such as github.com/mattn/go-sqlite3.
+type SqliteDialect struct{}
+
+func (d SqliteDialect) DriverName() string {
+	return "sqlite3"
+}
+
+// Returns "?"
+func (d SqliteDialect) BindVar(i int) string {
+	return "?"
+}
+
+func (d SqliteDialect) QuoteField(f string) string {
+	return `"` + strings.Replace(f, `"`, `""`, -1) + `"`
+}
+
+// Inserting NULL into an INTEGER PRIMARY KEY column makes SQLite assign
+// the next rowid.
+func (d SqliteDialect) AutoIncrBindValue() string {
+	return "NULL"
+}
+
+func (d SqliteDialect) AutoIncrInsertSuffix(col *ColumnMap) string {
+	return ""
+}
+
+func (d SqliteDialect) InsertAutoIncr(ctx context.Context, exec Conn, query string, args ...interface{}) (int64, error) {
+	return insertLastInsertId(ctx, exec, query, args...)
+}
+
+// SQLite returns the rowid of the last row of a multi-row INSERT. Rows
+// are written by a single writer so the ids are consecutive.
+func (d SqliteDialect) InsertAutoIncrBatch(ctx context.Context, exec Conn, query string, n int, args ...interface{}) ([]int64, error) {
+	last, err := insertLastInsertId(ctx, exec, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return autoIncrIds(last-int64(n)+1, n, 1), nil
+}
+
+// Returns 999, the limit of SQLite versions before 3.32.0.
+func (d SqliteDialect) MaxBindVars() int {
+	return 999
+}
+
+// ToSqlType returns the SQLite type name for the column. SQLite only
+// assigns rowids to columns declared exactly as "integer", so all integer
+// kinds map to it.
+func (d SqliteDialect) ToSqlType(col *ColumnMap) string {
+	if col.sqltype != "" {
+		return col.sqltype
+	}
+
+	t := sqlBaseType(col)
+
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "real"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "blob"
+		}
+	}
+
+	switch t.Name() {
+	case "NullInt64", "NullBool":
+		return "integer"
+	case "NullFloat64":
+		return "real"
+	case "Time", "NullTime":
+		return "datetime"
+	}
+
+	if col.MaxSize > 0 {
+		return fmt.Sprintf("varchar(%d)", col.MaxSize)
+	}
+	return "text"
+}
+
+// AutoIncrStr prevents SQLite from reusing the ids of deleted rows.
+func (d SqliteDialect) AutoIncrStr() string {
+	return "autoincrement"
+}
+
+func (d SqliteDialect) CreateTableSuffix() string {
+	return ""
+}
+
+// SQLite has no TRUNCATE statement.
+func (d SqliteDialect) TruncateClause() string {
+	return "delete from"
+}
+
+// BindVar returns the bind variable for the i'th argument using the
+// dialect of DefaultDBMap.
+func BindVar(i int) string {
+	return DefaultDBMap.dialect().BindVar(i)
+}
+
+// QuoteField quotes f using the dialect of DefaultDBMap.
+func QuoteField(f string) string {
+	return DefaultDBMap.dialect().QuoteField(f)
+}
+
 func FullMatch(v interface{}) string {
 	return fmt.Sprintf("%%%s%%", v)
 }
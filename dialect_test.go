@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type Counter struct {
+	CounterID uint32
+	Name      string
+}
+
+func TestInsertSql(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		query   string
+	}{
+		{MySQLDialect{}, "INSERT INTO `Friend` (`FriendID`,`Name`) VALUES (NULL,?);"},
+		{PostgresDialect{}, `INSERT INTO "Friend" ("FriendID","Name") VALUES (DEFAULT,$1) RETURNING "FriendID";`},
+		{SqliteDialect{}, `INSERT INTO "Friend" ("FriendID","Name") VALUES (NULL,?);`},
+	}
+
+	for _, tt := range tests {
+		table := NewDbMap(tt.dialect).AddTableWithName(Friend{}, "Friend").SetKeys(true, "FriendID")
+		bi := table.bindInsert(reflect.ValueOf(&Friend{Name: "a"}).Elem())
+
+		if bi.query != tt.query || bi.autoIncrIdx != 0 || len(bi.args) != 1 {
+			t.Errorf("%T: expected %s got %s %v", tt.dialect, tt.query, bi.query, bi.args)
+		}
+	}
+}
+
+func TestInsertAutoIncr(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	ctx := context.Background()
+
+	id, err := db.Dialect.InsertAutoIncr(ctx, db, "INSERT INTO Friend (Name) VALUES (?)", "a")
+
+	if err != nil || id != 1 {
+		t.Fatalf("expected 1, nil got %d, %v", id, err)
+	}
+
+	// SQLite also supports the RETURNING clause of Postgres
+	if _, ok := db.Dialect.(SqliteDialect); ok {
+		id, err = PostgresDialect{}.InsertAutoIncr(ctx, db, `INSERT INTO Friend (Name) VALUES ($1) RETURNING "FriendID"`, "b")
+
+		if err != nil || id != 2 {
+			t.Fatalf("expected 2, nil got %d, %v", id, err)
+		}
+	}
+}
+
+func TestSetAutoIncr(t *testing.T) {
+	c := Counter{}
+
+	if !setAutoIncr(reflect.ValueOf(&c).Elem().Field(0), 7) || c.CounterID != 7 {
+		t.Fatalf("expected 7 got %d", c.CounterID)
+	}
+
+	if setAutoIncr(reflect.ValueOf(&c).Elem().Field(1), 7) {
+		t.Fatalf("expected false for a string field")
+	}
+}
@@ -0,0 +1,218 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Categories of database errors, matched with errors.Is against the
+// errors returned by the query functions:
+//
+//	if errors.Is(err, database.ErrDuplicateKey) {
+//		...
+//	}
+var (
+	ErrDuplicateKey        = errors.New("Duplicate key")
+	ErrForeignKeyViolation = errors.New("Foreign key violation")
+	ErrDeadlock            = errors.New("Deadlock")
+	ErrLockWaitTimeout     = errors.New("Lock wait timeout")
+	ErrConnectionLost      = errors.New("Connection lost")
+	ErrDataTooLong         = errors.New("Data too long")
+)
+
+// Error is returned by the query functions when a statement fails. It
+// wraps the error of the driver, which errors.As still finds.
+//
+// ErrNoRows and the errors of a canceled or expired context are returned
+// as is.
+type Error struct {
+	// Op is the operation of the statement, see QueryEvent.Op.
+	Op string
+
+	// Table is the name of the table of Op, or "" if it is not known.
+	Table string
+
+	// Query is the statement, or "" if it is not known.
+	Query string
+
+	// Kind is the category of the error, one of ErrDuplicateKey,
+	// ErrForeignKeyViolation, ErrDeadlock, ErrLockWaitTimeout,
+	// ErrConnectionLost and ErrDataTooLong, or nil.
+	Kind error
+
+	// Index is the name of the violated unique index of ErrDuplicateKey
+	// when the driver reports it. SQLite reports the columns instead, as
+	// in "Account.Email".
+	Index string
+
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Table == "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Table, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the Kind of e.
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// ErrorClassifier is implemented by dialects that map the errors of their
+// driver to the categories of Error.Kind.
+type ErrorClassifier interface {
+	// ClassifyError returns the category of err, or nil if it has none,
+	// and the name of the violated index of ErrDuplicateKey.
+	ClassifyError(err error) (kind error, index string)
+}
+
+// classifyError returns the category of err using the ErrorClassifier of
+// d, or ErrConnectionLost for the connection errors of database/sql.
+func classifyError(d Dialect, err error) (error, string) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind, e.Index
+	}
+
+	if c, ok := d.(ErrorClassifier); ok {
+		if kind, index := c.ClassifyError(err); kind != nil {
+			return kind, index
+		}
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return ErrConnectionLost, ""
+	}
+	return nil, ""
+}
+
+// wrapError wraps the error of the statement query of op on table in an
+// *Error classified by d.
+func wrapError(ctx context.Context, d Dialect, op, table, query string, err error) error {
+	if err == nil || err == sql.ErrNoRows || err == ctx.Err() {
+		return err
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	kind, index := classifyError(d, err)
+	return &Error{Op: op, Table: table, Query: query, Kind: kind, Index: index, Err: err}
+}
+
+// connDialect returns the dialect of conn if it is a *DB or *Tx, and the
+// dialect of m otherwise.
+func connDialect(m *DbMap, conn Conn) Dialect {
+	switch c := conn.(type) {
+	case *DB:
+		if c.Dialect != nil {
+			return c.Dialect
+		}
+	case *Tx:
+		if c.db != nil && c.db.Dialect != nil {
+			return c.db.Dialect
+		}
+	}
+	return m.dialect()
+}
+
+// MySQL reports the index as 'name' or, since 8.0, as 'table.name'.
+var mysqlDupKeyRe = regexp.MustCompile(`for key '(?:[^'.]*\.)?([^']*)'$`)
+
+func (d MySQLDialect) ClassifyError(err error) (error, string) {
+	if errors.Is(err, mysql.ErrInvalidConn) {
+		return ErrConnectionLost, ""
+	}
+
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return nil, ""
+	}
+
+	switch myErr.Number {
+	case 1062, 1586:
+		index := ""
+		if m := mysqlDupKeyRe.FindStringSubmatch(myErr.Message); m != nil {
+			index = m[1]
+		}
+		return ErrDuplicateKey, index
+	case 1216, 1217, 1451, 1452:
+		return ErrForeignKeyViolation, ""
+	case 1213:
+		return ErrDeadlock, ""
+	case 1205:
+		return ErrLockWaitTimeout, ""
+	case 1406:
+		return ErrDataTooLong, ""
+	case 1053, 2006, 2013:
+		return ErrConnectionLost, ""
+	}
+	return nil, ""
+}
+
+var pgConstraintRe = regexp.MustCompile(`unique constraint "([^"]*)"`)
+
+// ClassifyError maps the SQLSTATE of errors with a SQLState method, such
+// as those of lib/pq and pgx.
+func (d PostgresDialect) ClassifyError(err error) (error, string) {
+	var pgErr interface{ SQLState() string }
+	if !errors.As(err, &pgErr) {
+		return nil, ""
+	}
+
+	switch code := pgErr.SQLState(); {
+	case code == "23505":
+		index := ""
+		if m := pgConstraintRe.FindStringSubmatch(err.Error()); m != nil {
+			index = m[1]
+		}
+		return ErrDuplicateKey, index
+	case code == "23503":
+		return ErrForeignKeyViolation, ""
+	case code == "40P01":
+		return ErrDeadlock, ""
+	case code == "55P03":
+		return ErrLockWaitTimeout, ""
+	case code == "22001":
+		return ErrDataTooLong, ""
+	case strings.HasPrefix(code, "08"), code == "57P01", code == "57P02", code == "57P03":
+		return ErrConnectionLost, ""
+	}
+	return nil, ""
+}
+
+// ClassifyError maps the messages of SQLite, which does not detect
+// deadlocks or enforce column sizes: a busy database is a lock wait
+// timeout and only values over the SQLite limits are too long.
+func (d SqliteDialect) ClassifyError(err error) (error, string) {
+	msg := err.Error()
+
+	switch {
+	case strings.HasPrefix(msg, "UNIQUE constraint failed: "):
+		return ErrDuplicateKey, strings.TrimPrefix(msg, "UNIQUE constraint failed: ")
+	case strings.HasPrefix(msg, "PRIMARY KEY must be unique"):
+		return ErrDuplicateKey, ""
+	case strings.HasPrefix(msg, "FOREIGN KEY constraint failed"):
+		return ErrForeignKeyViolation, ""
+	case strings.HasPrefix(msg, "database is locked"), strings.HasPrefix(msg, "database table is locked"):
+		return ErrLockWaitTimeout, ""
+	case strings.HasPrefix(msg, "string or blob too big"):
+		return ErrDataTooLong, ""
+	}
+	return nil, ""
+}
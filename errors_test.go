@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// pgError has the SQLState method of the errors of lib/pq and pgx.
+type pgError struct {
+	code string
+	msg  string
+}
+
+func (e *pgError) Error() string    { return "pq: " + e.msg }
+func (e *pgError) SQLState() string { return e.code }
+
+func TestDuplicateKeyError(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	if err := Insert(db, &Account{Email: "a@example.com", Name: "A"}); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	err := Insert(db, &Account{Email: "a@example.com", Name: "B"})
+
+	var e *Error
+	if !errors.Is(err, ErrDuplicateKey) || !errors.As(err, &e) {
+		t.Fatalf("expected duplicate key got %v", err)
+	}
+
+	if e.Op != "insert" || e.Table != "Account" || e.Query == "" || e.Index == "" {
+		t.Fatalf("unexpected error %+v", e)
+	}
+
+	if errors.Is(err, ErrForeignKeyViolation) || ErrorClass(err) != "duplicate_key" {
+		t.Fatalf("unexpected class of %v", err)
+	}
+
+	// statements of other errors are wrapped without a kind
+	_, err = Exec(db, "SELECT * FROM Missing WHERE id = ?", 1)
+	if !errors.As(err, &e) || e.Kind != nil || e.Op != "exec" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+
+	_, err = QueryRowx(db, "SELECT * FROM Missing WHERE id = ?", 1)
+	if !errors.As(err, &e) || e.Query != "SELECT * FROM Missing WHERE id = ?" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	for _, tt := range []struct {
+		d     Dialect
+		err   error
+		kind  error
+		index string
+	}{
+		{MySQLDialect{}, &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a' for key 'Account.Email'"}, ErrDuplicateKey, "Email"},
+		{MySQLDialect{}, &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a' for key 'Email'"}, ErrDuplicateKey, "Email"},
+		{MySQLDialect{}, &mysql.MySQLError{Number: 1452}, ErrForeignKeyViolation, ""},
+		{MySQLDialect{}, &mysql.MySQLError{Number: 1213}, ErrDeadlock, ""},
+		{MySQLDialect{}, &mysql.MySQLError{Number: 1205}, ErrLockWaitTimeout, ""},
+		{MySQLDialect{}, &mysql.MySQLError{Number: 1406}, ErrDataTooLong, ""},
+		{MySQLDialect{}, mysql.ErrInvalidConn, ErrConnectionLost, ""},
+		{MySQLDialect{}, &mysql.MySQLError{Number: 1146}, nil, ""},
+		{PostgresDialect{}, &pgError{"23505", `duplicate key value violates unique constraint "account_email_key"`}, ErrDuplicateKey, "account_email_key"},
+		{PostgresDialect{}, &pgError{code: "23503"}, ErrForeignKeyViolation, ""},
+		{PostgresDialect{}, &pgError{code: "40P01"}, ErrDeadlock, ""},
+		{PostgresDialect{}, &pgError{code: "55P03"}, ErrLockWaitTimeout, ""},
+		{PostgresDialect{}, &pgError{code: "22001"}, ErrDataTooLong, ""},
+		{PostgresDialect{}, &pgError{code: "08006"}, ErrConnectionLost, ""},
+		{SqliteDialect{}, errors.New("UNIQUE constraint failed: Account.Email"), ErrDuplicateKey, "Account.Email"},
+		{SqliteDialect{}, errors.New("FOREIGN KEY constraint failed"), ErrForeignKeyViolation, ""},
+		{SqliteDialect{}, errors.New("database is locked"), ErrLockWaitTimeout, ""},
+		{SqliteDialect{}, driver.ErrBadConn, ErrConnectionLost, ""},
+		// each dialect only maps the errors of its driver
+		{SqliteDialect{}, &mysql.MySQLError{Number: 1213}, nil, ""},
+		{MySQLDialect{}, &pgError{code: "40P01"}, nil, ""},
+	} {
+		err := wrapError(context.Background(), tt.d, opExec, "", "", tt.err)
+
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%v: cause not found in %v", tt.err, err)
+		}
+
+		var e *Error
+		if !errors.As(err, &e) || e.Kind != tt.kind || e.Index != tt.index {
+			t.Errorf("%T %v: expected %v %q got %+v", tt.d, tt.err, tt.kind, tt.index, e)
+		}
+
+		if tt.kind != nil && !errors.Is(err, tt.kind) {
+			t.Errorf("%v: expected errors.Is %v", err, tt.kind)
+		}
+	}
+}
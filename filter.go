@@ -0,0 +1,322 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FilterOp is the comparison a Filter makes between its column and the
+// value of its key.
+type FilterOp int
+
+const (
+	// OpEq matches column = value.
+	OpEq FilterOp = iota
+
+	// OpIn matches column IN (values) for a slice and column = value
+	// otherwise. An empty slice matches no rows.
+	OpIn
+
+	// OpFullMatch, OpSuffixMatch and OpPreMatch match column LIKE the
+	// value wrapped by FullMatch, SuffixMatch and PreMatch. A slice
+	// matches any of its values.
+	OpFullMatch
+	OpSuffixMatch
+	OpPreMatch
+
+	// OpRange matches From <= column <= To, given a Range value.
+	OpRange
+
+	// OpIsNull matches column IS NULL for true and IS NOT NULL for false.
+	OpIsNull
+)
+
+// FilterType is the Go type a Filter accepts as value, alone or in a
+// slice.
+type FilterType int
+
+const (
+	FilterString FilterType = iota
+	FilterInt64             // any signed integer type
+	FilterTime              // time.Time
+	FilterBool
+)
+
+func (t FilterType) String() string {
+	switch t {
+	case FilterString:
+		return "string"
+	case FilterInt64:
+		return "int64"
+	case FilterTime:
+		return "time.Time"
+	case FilterBool:
+		return "bool"
+	}
+	return fmt.Sprintf("FilterType(%d)", int(t))
+}
+
+// Range is the value of an OpRange filter. A nil bound leaves the range
+// open on that side.
+type Range struct {
+	From interface{}
+	To   interface{}
+}
+
+// Filter declares how the value of Key in an Args map restricts the rows
+// of a table.
+type Filter struct {
+	Key string
+
+	// Column is the field or column name the filter applies to. It
+	// defaults to Key.
+	Column string
+
+	Op   FilterOp
+	Type FilterType
+}
+
+// FilterSet holds the filters of a table, see TableMap.Filters.
+type FilterSet struct {
+	table   *TableMap
+	filters map[string]Filter
+	columns map[string]*ColumnMap
+}
+
+// Filters returns the set of the given filters on the table. It panics
+// if a filter names a column the table does not have.
+//
+//	friendFilters := table.Filters(
+//		Filter{Key: "id", Column: "FriendID", Op: OpIn, Type: FilterInt64},
+//		Filter{Key: "name", Column: "Name", Op: OpSuffixMatch, Type: FilterString},
+//	)
+//
+//	w, args := []string{}, []interface{}{}
+//	if err := friendFilters.Apply(db, filter, &w, &args); err != nil {
+//		return err
+//	}
+//	query := "SELECT * FROM Friend" + PrepareWhere(w)
+func (t *TableMap) Filters(filters ...Filter) *FilterSet {
+	fs := &FilterSet{
+		table:   t,
+		filters: make(map[string]Filter, len(filters)),
+		columns: make(map[string]*ColumnMap, len(filters)),
+	}
+
+	for _, f := range filters {
+		name := f.Column
+		if name == "" {
+			name = f.Key
+		}
+		fs.filters[f.Key] = f
+		fs.columns[f.Key] = t.ColMap(name)
+	}
+	return fs
+}
+
+// Apply appends a WHERE fragment to w and its arguments to params for
+// each key of args, in key order, for a query run on conn. Bind variables
+// are numbered from len(*params) and, like the quoting of the columns,
+// follow the dialect of conn if it is a *DB or *Tx and that of the DbMap
+// of the table otherwise. It fails on keys without a filter and on values
+// of the wrong type.
+func (fs *FilterSet) Apply(conn Conn, args Args, w *[]string, params *[]interface{}) error {
+	d := connDialect(fs.table.dbmap, conn)
+	return fs.apply(args, w, params, d.QuoteField, func() string { return d.BindVar(len(*params)) })
+}
+
+// Filter adds the conditions of fs for args to the builder, see Apply.
+func (b *SelectBuilder) Filter(fs *FilterSet, args Args) *SelectBuilder {
+	var w []string
+	var params []interface{}
+
+	if err := fs.apply(args, &w, &params, ident, func() string { return "?" }); err != nil {
+		b.setErr(err)
+		return b
+	}
+
+	for _, cond := range w {
+		b.And(cond)
+	}
+	b.whereArgs = append(b.whereArgs, params...)
+	return b
+}
+
+func (fs *FilterSet) apply(args Args, w *[]string, params *[]interface{}, quote func(string) string, bindVar func() string) error {
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		f, ok := fs.filters[k]
+		if !ok {
+			return fmt.Errorf("Unknown filter %s for table %s", k, fs.table.TableName)
+		}
+
+		frag, err := fs.where(f, args[k], params, quote, bindVar)
+		if err != nil {
+			return err
+		}
+		*w = append(*w, frag)
+	}
+	return nil
+}
+
+func (fs *FilterSet) where(f Filter, value interface{}, params *[]interface{}, quote func(string) string, bindVar func() string) (string, error) {
+	column := quote(fs.table.TableName) + "." + quote(fs.columns[f.Key].ColumnName)
+
+	bind := func(v interface{}) string {
+		s := bindVar()
+		*params = append(*params, v)
+		return s
+	}
+
+	switch f.Op {
+	case OpIsNull:
+		isNull, ok := value.(bool)
+		if !ok {
+			return "", fmt.Errorf("expected %s type bool, got %T", f.Key, value)
+		}
+		if isNull {
+			return column + " IS NULL", nil
+		}
+		return column + " IS NOT NULL", nil
+
+	case OpRange:
+		r, ok := value.(Range)
+		if !ok {
+			return "", fmt.Errorf("expected %s type Range, got %T", f.Key, value)
+		}
+
+		var parts []string
+		for _, b := range []struct {
+			op string
+			v  interface{}
+		}{{" >= ", r.From}, {" <= ", r.To}} {
+			if b.v == nil {
+				continue
+			}
+			v, err := f.check(b.v)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, column+b.op+bind(v))
+		}
+
+		if len(parts) == 0 {
+			return "", fmt.Errorf("Range %s needs a bound", f.Key)
+		}
+		return strings.Join(parts, " AND "), nil
+	}
+
+	values, isSlice, err := f.values(value)
+	if err != nil {
+		return "", err
+	}
+
+	switch f.Op {
+	case OpEq:
+		if isSlice {
+			return "", fmt.Errorf("expected %s type %s, got %T", f.Key, f.Type, value)
+		}
+		return column + " = " + bind(values[0]), nil
+
+	case OpIn:
+		if !isSlice {
+			return column + " = " + bind(values[0]), nil
+		}
+		if len(values) == 0 {
+			return "1=0", nil
+		}
+
+		s := bytes.Buffer{}
+		s.WriteString(column)
+		s.WriteString(" IN (")
+		for i, v := range values {
+			if i > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(bind(v))
+		}
+		s.WriteString(")")
+		return s.String(), nil
+
+	case OpFullMatch, OpSuffixMatch, OpPreMatch:
+		if f.Type != FilterString {
+			return "", fmt.Errorf("Filter %s: LIKE needs type string, got %s", f.Key, f.Type)
+		}
+		if len(values) == 0 {
+			return "1=0", nil
+		}
+
+		match := map[FilterOp]func(interface{}) string{
+			OpFullMatch:   FullMatch,
+			OpSuffixMatch: SuffixMatch,
+			OpPreMatch:    PreMatch,
+		}[f.Op]
+
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = column + " LIKE " + bind(match(v))
+		}
+		if len(parts) == 1 {
+			return parts[0], nil
+		}
+		return "(" + strings.Join(parts, " OR ") + ")", nil
+	}
+
+	return "", fmt.Errorf("Filter %s has unknown op %d", f.Key, f.Op)
+}
+
+// values returns value, or the elements of value if it is a slice,
+// checked against the type of the filter.
+func (f Filter) values(value interface{}) ([]interface{}, bool, error) {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice {
+		x, err := f.check(value)
+		return []interface{}{x}, false, err
+	}
+
+	values := make([]interface{}, v.Len())
+	for i := range values {
+		x, err := f.check(v.Index(i).Interface())
+		if err != nil {
+			return nil, true, err
+		}
+		values[i] = x
+	}
+	return values, true, nil
+}
+
+// check returns value converted to the type of the filter, or an error
+// if it has another type.
+func (f Filter) check(value interface{}) (interface{}, error) {
+	v := reflect.ValueOf(value)
+
+	switch f.Type {
+	case FilterString:
+		if v.Kind() == reflect.String {
+			return v.String(), nil
+		}
+	case FilterInt64:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return v.Int(), nil
+		}
+	case FilterTime:
+		if t, ok := value.(time.Time); ok {
+			return t, nil
+		}
+	case FilterBool:
+		if v.Kind() == reflect.Bool {
+			return v.Bool(), nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s type %s or []%s, got %T", f.Key, f.Type, f.Type, value)
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type Listing struct {
+	ListingID int64
+	Title     string
+	Price     int64
+	Active    bool
+	Listed    time.Time
+	Note      *string
+}
+
+func TestFilters(t *testing.T) {
+	table := NewDbMap(PostgresDialect{}).AddTable(Listing{})
+	fs := table.Filters(
+		Filter{Key: "id", Column: "ListingID", Op: OpIn, Type: FilterInt64},
+		Filter{Key: "title", Column: "Title", Op: OpFullMatch, Type: FilterString},
+		Filter{Key: "price", Column: "Price", Op: OpRange, Type: FilterInt64},
+		Filter{Key: "active", Column: "Active", Op: OpEq, Type: FilterBool},
+		Filter{Key: "listed", Column: "Listed", Op: OpRange, Type: FilterTime},
+		Filter{Key: "noted", Column: "Note", Op: OpIsNull},
+	)
+
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	w := []string{"x = $1"}
+	params := []interface{}{"x"}
+
+	err := fs.Apply(nil, Args{
+		"id":     []int{1, 2},
+		"title":  []string{"a", "b"},
+		"price":  Range{From: 10},
+		"active": true,
+		"listed": Range{From: day, To: day},
+		"noted":  false,
+	}, &w, &params)
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	want := []string{
+		"x = $1",
+		`"Listing"."Active" = $2`,
+		`"Listing"."ListingID" IN ($3, $4)`,
+		`"Listing"."Listed" >= $5 AND "Listing"."Listed" <= $6`,
+		`"Listing"."Note" IS NOT NULL`,
+		`"Listing"."Price" >= $7`,
+		`("Listing"."Title" LIKE $8 OR "Listing"."Title" LIKE $9)`,
+	}
+
+	if !reflect.DeepEqual(w, want) {
+		t.Fatalf("expected\n%v\ngot\n%v", want, w)
+	}
+
+	wantParams := []interface{}{"x", true, int64(1), int64(2), day, day, int64(10), "%a%", "%b%"}
+	if !reflect.DeepEqual(params, wantParams) {
+		t.Fatalf("expected %v got %v", wantParams, params)
+	}
+
+	for _, args := range []Args{
+		{"unknown": 1},
+		{"id": "1"},
+		{"active": []bool{true}},
+		{"price": Range{}},
+		{"noted": 1},
+	} {
+		if err := fs.Apply(nil, args, &w, &params); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+
+	// the dialect of the connection wins over that of the DbMap
+	fs = NewDbMap(MySQLDialect{}).AddTable(Listing{}).Filters(fs.filters["id"])
+	w, params = nil, nil
+
+	if err := fs.Apply(&DB{Dialect: PostgresDialect{}}, Args{"id": []int{1}}, &w, &params); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if want := []string{`"Listing"."ListingID" IN ($1)`}; !reflect.DeepEqual(w, want) {
+		t.Fatalf("expected %v got %v", want, w)
+	}
+}
+
+func TestSelectBuilderFilter(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	for _, name := range []string{"Ann", "Anna", "Bob"} {
+		if err := Insert(db, &Friend{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := DefaultDBMap.TableFor(Friend{})
+	fs := table.Filters(
+		Filter{Key: "id", Column: "FriendID", Op: OpIn, Type: FilterInt64},
+		Filter{Key: "name", Column: "Name", Op: OpSuffixMatch, Type: FilterString},
+	)
+
+	var friends []Friend
+
+	err := table.Query().
+		Where("Name <> ?", "Anna").
+		Filter(fs, Args{"name": "A", "id": []int{1, 2, 3}}).
+		Select(db, &friends)
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if len(friends) != 1 || friends[0].Name != "Ann" {
+		t.Fatalf("expected Ann got %v", friends)
+	}
+
+	if err := table.Query().Filter(fs, Args{"age": 1}).Select(db, &friends); err == nil {
+		t.Fatalf("expected error for unknown filter")
+	}
+}
@@ -0,0 +1,66 @@
+package database
+
+import "reflect"
+
+// The hook interfaces may be implemented by the pointer types of mapped
+// structs. Insert, Update and Delete call the Pre hook of each element
+// before generating its statement and abort if it returns an error; the
+// Post hook is called after the statement succeeded. Select calls
+// PostGet for every scanned struct.
+
+type PreInserter interface {
+	PreInsert(Conn) error
+}
+
+type PostInserter interface {
+	PostInsert(Conn) error
+}
+
+type PreUpdater interface {
+	PreUpdate(Conn) error
+}
+
+type PostUpdater interface {
+	PostUpdate(Conn) error
+}
+
+type PreDeleter interface {
+	PreDelete(Conn) error
+}
+
+type PostDeleter interface {
+	PostDelete(Conn) error
+}
+
+type PostGetter interface {
+	PostGet(Conn) error
+}
+
+// runPostGet calls PostGet on dest, a pointer to a struct or to a slice
+// of structs or struct pointers.
+func runPostGet(exec Conn, dest interface{}) error {
+	if v, ok := dest.(PostGetter); ok {
+		return v.PostGet(exec)
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(dest))
+
+	if v.Kind() != reflect.Slice {
+		return nil
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		e := v.Index(i)
+
+		if e.Kind() != reflect.Ptr {
+			e = e.Addr()
+		}
+
+		if hook, ok := e.Interface().(PostGetter); ok {
+			if err := hook.PostGet(exec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+type Event struct {
+	EventID int
+	Name    string
+	Calls   []string `db:"-"`
+}
+
+var errRejected = errors.New("rejected")
+
+func (e *Event) PreInsert(Conn) error {
+	if e.Name == "" {
+		e.Name = "unnamed"
+	}
+	e.Calls = append(e.Calls, "PreInsert")
+	return nil
+}
+
+func (e *Event) PostInsert(Conn) error {
+	e.Calls = append(e.Calls, "PostInsert")
+	return nil
+}
+
+func (e *Event) PreUpdate(Conn) error {
+	if e.Name == "reject" {
+		return errRejected
+	}
+	e.Calls = append(e.Calls, "PreUpdate")
+	return nil
+}
+
+func (e *Event) PostDelete(Conn) error {
+	e.Calls = append(e.Calls, "PostDelete")
+	return nil
+}
+
+func (e *Event) PostGet(Conn) error {
+	e.Calls = append(e.Calls, "PostGet")
+	return nil
+}
+
+func init() {
+	DefaultDBMap.AddTableWithName(Event{}, "Event").SetKeys(true, "EventID")
+}
+
+func TestHooks(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	e := &Event{}
+
+	if err := Insert(db, e); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if e.Name != "unnamed" || len(e.Calls) != 2 || e.Calls[1] != "PostInsert" {
+		t.Fatalf("unexpected %+v", e)
+	}
+
+	e.Name = "reject"
+
+	if _, err := Update(db, e); err != errRejected {
+		t.Fatalf("expected %v got %v", errRejected, err)
+	}
+
+	var events []Event
+
+	if err := Select(db, &events, "SELECT * FROM Event"); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if len(events) != 1 || events[0].Name != "unnamed" || len(events[0].Calls) != 1 {
+		t.Fatalf("unexpected %+v", events)
+	}
+
+	var one Event
+
+	if err := Select(db, &one, "SELECT * FROM Event"); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if len(one.Calls) != 1 || one.Calls[0] != "PostGet" {
+		t.Fatalf("unexpected %+v", one)
+	}
+
+	if _, err := Delete(db, &one); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if one.Calls[1] != "PostDelete" {
+		t.Fatalf("unexpected %+v", one)
+	}
+}
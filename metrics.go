@@ -0,0 +1,281 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations reported in QueryEvent.Op.
+const (
+	opInsert = "insert"
+	opUpdate = "update"
+	opDelete = "delete"
+	opGet    = "get"
+	opSelect = "select"
+	opUpsert = "upsert"
+	opExec   = "exec"
+)
+
+type opKey struct{}
+
+type opInfo struct {
+	op    string
+	table string
+}
+
+// withOp marks the statements run with ctx as operation op on table.
+func withOp(ctx context.Context, op, table string) context.Context {
+	return context.WithValue(ctx, opKey{}, opInfo{op, table})
+}
+
+// DefaultLatencyBuckets are the upper bounds of the latency histograms of
+// Metrics.
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Metrics is a QueryObserver counting the statements of a DB by
+// operation and table. Statements that do not belong to a table, such as
+// those of Exec, are grouped by their Fingerprint instead.
+//
+//	m := database.NewMetrics(db)
+//	db.Observer = m
+//	m.Publish("database")
+type Metrics struct {
+	// Buckets are the upper bounds of the latency histograms. They
+	// default to DefaultLatencyBuckets and must not change once the
+	// first statement was observed.
+	Buckets []time.Duration
+
+	db *DB
+
+	mu  sync.Mutex
+	ops map[OpKey]*OpMetrics
+}
+
+// OpKey identifies the statements counted together by Metrics.
+type OpKey struct {
+	// Op is one of insert, update, delete, get, select, upsert and exec.
+	Op string
+
+	// Table is the name of the table of the statements, or "" for
+	// statements grouped by Fingerprint.
+	Table string
+
+	Fingerprint string
+}
+
+// OpMetrics are the counters of the statements of an OpKey.
+type OpMetrics struct {
+	Count int64
+
+	// Errors counts the failed statements by ErrorClass.
+	Errors map[string]int64
+
+	// Latency counts the statements with a duration up to each of the
+	// Buckets of Metrics, and Latency[len(Buckets)] the slower ones.
+	Latency []int64
+
+	// Total is the sum of the durations of the statements.
+	Total time.Duration
+}
+
+// StmtCacheStats are the counters of the prepared statement cache of a
+// DB, see DB.SetStmtCacheSize.
+type StmtCacheStats struct {
+	Hits   int64
+	Misses int64
+	Size   int
+}
+
+// MetricsSnapshot is a copy of the state of Metrics.
+type MetricsSnapshot struct {
+	Buckets   []time.Duration
+	Ops       map[OpKey]OpMetrics
+	StmtCache StmtCacheStats
+	Pool      sql.DBStats
+}
+
+// NewMetrics returns a Metrics reporting the pool and statement cache
+// statistics of db, which may be nil. Set it as the Observer of db to
+// count statements.
+func NewMetrics(db *DB) *Metrics {
+	return &Metrics{db: db, ops: make(map[OpKey]*OpMetrics)}
+}
+
+func (m *Metrics) buckets() []time.Duration {
+	if m.Buckets == nil {
+		return DefaultLatencyBuckets
+	}
+	return m.Buckets
+}
+
+func (m *Metrics) ObserveQuery(ctx context.Context, e *QueryEvent) {
+	key := OpKey{Op: e.Op, Table: e.Table}
+	if key.Table == "" {
+		key.Fingerprint = Fingerprint(e.Query)
+	}
+
+	buckets := m.buckets()
+	b := sort.Search(len(buckets), func(i int) bool { return e.Duration <= buckets[i] })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	op, ok := m.ops[key]
+	if !ok {
+		op = &OpMetrics{Latency: make([]int64, len(buckets)+1)}
+		m.ops[key] = op
+	}
+
+	op.Count++
+	op.Latency[b]++
+	op.Total += e.Duration
+
+	if e.Err != nil {
+		if op.Errors == nil {
+			op.Errors = make(map[string]int64)
+		}
+		op.Errors[ErrorClass(e.Err)]++
+	}
+}
+
+// Snapshot returns a copy of the counters, to be read by exporters.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	s := MetricsSnapshot{Buckets: m.buckets()}
+
+	m.mu.Lock()
+	s.Ops = make(map[OpKey]OpMetrics, len(m.ops))
+	for k, op := range m.ops {
+		c := *op
+		c.Latency = append([]int64(nil), op.Latency...)
+		if op.Errors != nil {
+			c.Errors = make(map[string]int64, len(op.Errors))
+			for class, n := range op.Errors {
+				c.Errors[class] = n
+			}
+		}
+		s.Ops[k] = c
+	}
+	m.mu.Unlock()
+
+	if m.db != nil {
+		s.StmtCache = m.db.stmtCache.stats()
+		s.Pool = m.db.Stats()
+	}
+	return s
+}
+
+// Publish exports the snapshot of m as the expvar variable name.
+func (m *Metrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return m.expvar()
+	}))
+}
+
+// expvar returns the snapshot in a JSON friendly form, with the
+// operations keyed by "op table" or "op fingerprint".
+func (m *Metrics) expvar() interface{} {
+	s := m.Snapshot()
+
+	buckets := make([]string, len(s.Buckets))
+	for i, b := range s.Buckets {
+		buckets[i] = b.String()
+	}
+
+	ops := make(map[string]interface{}, len(s.Ops))
+	for k, op := range s.Ops {
+		name := k.Op + " " + k.Table
+		if k.Table == "" {
+			name = k.Op + " " + k.Fingerprint
+		}
+		ops[name] = map[string]interface{}{
+			"count":    op.Count,
+			"errors":   op.Errors,
+			"latency":  op.Latency,
+			"total_ms": float64(op.Total) / float64(time.Millisecond),
+		}
+	}
+
+	hitRate := 0.0
+	if n := s.StmtCache.Hits + s.StmtCache.Misses; n > 0 {
+		hitRate = float64(s.StmtCache.Hits) / float64(n)
+	}
+
+	return map[string]interface{}{
+		"buckets": buckets,
+		"ops":     ops,
+		"stmt_cache": map[string]interface{}{
+			"hits":     s.StmtCache.Hits,
+			"misses":   s.StmtCache.Misses,
+			"size":     s.StmtCache.Size,
+			"hit_rate": hitRate,
+		},
+		"pool": s.Pool,
+	}
+}
+
+// ErrorClass returns a short name for the kind of err, used to count
+// errors in Metrics: "no_rows", "canceled", "timeout", "connection",
+// "duplicate_key", "foreign_key", "deadlock", "lock_wait_timeout",
+// "data_too_long" or "other". See Error for the classification of
+// database errors.
+func ErrorClass(err error) string {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return "no_rows"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrConnectionLost), errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone):
+		return "connection"
+	case errors.Is(err, ErrDuplicateKey):
+		return "duplicate_key"
+	case errors.Is(err, ErrForeignKeyViolation):
+		return "foreign_key"
+	case errors.Is(err, ErrDeadlock):
+		return "deadlock"
+	case errors.Is(err, ErrLockWaitTimeout):
+		return "lock_wait_timeout"
+	case errors.Is(err, ErrDataTooLong):
+		return "data_too_long"
+	}
+	return "other"
+}
+
+var (
+	fingerprintLitRe    = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|\$\d+|\b\d+(?:\.\d+)?\b`)
+	fingerprintListRe   = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	fingerprintValuesRe = regexp.MustCompile(`(\(\?\))(?:\s*,\s*\(\?\))+`)
+	fingerprintSpaceRe  = regexp.MustCompile(`\s+`)
+)
+
+// Fingerprint normalizes query so that statements differing only in
+// literal values, the length of IN lists or the number of inserted rows
+// are equal: literals and bind variables become "?", lists of them
+// become "(?)" and whitespace is collapsed.
+func Fingerprint(query string) string {
+	s := fingerprintLitRe.ReplaceAllString(query, "?")
+	s = fingerprintSpaceRe.ReplaceAllString(s, " ")
+	s = fingerprintListRe.ReplaceAllString(s, "(?)")
+	s = fingerprintValuesRe.ReplaceAllString(s, "$1")
+	return strings.TrimSuffix(strings.TrimSpace(s), ";")
+}
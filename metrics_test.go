@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	m := NewMetrics(db)
+	db.Observer = m
+	db.SetStmtCacheSize(8)
+	defer func() {
+		db.Observer = nil
+		db.SetStmtCacheSize(0)
+	}()
+
+	f := &Friend{Name: "Foo"}
+
+	if err := Insert(db, f); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := Get(db, &Friend{}, f.FriendID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var friends []*Friend
+	if err := Select(db, &friends, "SELECT * FROM Friend"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"'a'", "'b'"} {
+		if _, err := Exec(db, "UPDATE Friend SET Name = "+name+" WHERE FriendID IN (1, 2)"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Exec(db, "SELECT * FROM Missing WHERE id = ?", 1); err == nil {
+		t.Fatal("expected error")
+	}
+
+	s := m.Snapshot()
+
+	for key, want := range map[OpKey]int64{
+		{Op: "insert", Table: "Friend"}: 1,
+		{Op: "get", Table: "Friend"}:    2,
+		{Op: "select", Table: "Friend"}: 1,
+		{Op: "exec", Fingerprint: "UPDATE Friend SET Name = ? WHERE FriendID IN (?)"}: 2,
+	} {
+		if got := s.Ops[key].Count; got != want {
+			t.Errorf("%+v: expected %d got %d", key, want, got)
+		}
+	}
+
+	failed := s.Ops[OpKey{Op: "exec", Fingerprint: "SELECT * FROM Missing WHERE id = ?"}]
+	if failed.Count != 1 || failed.Errors["other"] != 1 {
+		t.Errorf("unexpected error counts %+v", failed)
+	}
+
+	var n int64
+	for _, c := range s.Ops[OpKey{Op: "get", Table: "Friend"}].Latency {
+		n += c
+	}
+	if n != 2 {
+		t.Errorf("expected 2 latencies got %d", n)
+	}
+
+	if s.StmtCache.Hits != 1 || s.StmtCache.Misses != 3 {
+		t.Errorf("unexpected cache stats %+v", s.StmtCache)
+	}
+
+	if s.Pool.OpenConnections != 1 {
+		t.Errorf("unexpected pool stats %+v", s.Pool)
+	}
+
+	if _, err := json.Marshal(m.expvar()); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	for query, want := range map[string]string{
+		"SELECT *\n  FROM t WHERE a = 'it''s' AND b IN (1, 2,3);": "SELECT * FROM t WHERE a = ? AND b IN (?)",
+		`SELECT * FROM t2 WHERE a = $1 AND b > 2.5`:               "SELECT * FROM t2 WHERE a = ? AND b > ?",
+		"INSERT INTO t (a, b) VALUES (?, ?), (?, ?)":              "INSERT INTO t (a, b) VALUES (?)",
+	} {
+		if got := Fingerprint(query); got != want {
+			t.Errorf("%q: expected %q got %q", query, want, got)
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for err, want := range map[error]string{
+		ErrNoRows: "no_rows",
+		ctx.Err(): "canceled",
+	} {
+		if got := ErrorClass(err); got != want {
+			t.Errorf("%v: expected %s got %s", err, want, got)
+		}
+	}
+}
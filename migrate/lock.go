@@ -0,0 +1,155 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/simonklee/database"
+)
+
+// ErrLocked is returned when the migration lock could not be acquired
+// within the lock timeout.
+var ErrLocked = errors.New("migrate: timed out waiting for migration lock")
+
+// lock takes a named, connection scoped lock so that concurrent
+// instances do not migrate at the same time. The lock is held by a
+// dedicated connection until the returned function is called, so the
+// pool of DB needs a second connection to run the migrations.
+//
+// SQLite has no advisory locks; its lock is a row in a lock table, see
+// sqliteLock.
+func (m *Migrator) lock(ctx context.Context) (func() error, error) {
+	var acquire, release string
+	var args []interface{}
+	var usesGetLock bool
+
+	switch m.DB.Dialect.(type) {
+	case database.MySQLDialect, *database.MySQLDialect:
+		acquire = "SELECT GET_LOCK(?, ?)"
+		release = "SELECT RELEASE_LOCK(?)"
+		args = []interface{}{m.lockName(), lockSeconds(m.lockTimeout())}
+		usesGetLock = true
+	case database.PostgresDialect, *database.PostgresDialect:
+		acquire = "SELECT pg_advisory_lock($1)"
+		release = "SELECT pg_advisory_unlock($1)"
+		args = []interface{}{m.lockKey()}
+	case database.SqliteDialect, *database.SqliteDialect:
+		return m.sqliteLock(ctx)
+	default:
+		return nil, fmt.Errorf("migrate: no migration lock for %T", m.DB.Dialect)
+	}
+
+	if m.DB.Stats().MaxOpenConnections == 1 {
+		return nil, errors.New("migrate: the lock holds a connection, DB needs MaxOpenConns of at least 2")
+	}
+
+	conn, err := m.DB.Conn(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lockCtx, cancel := context.WithTimeout(ctx, m.lockTimeout())
+	defer cancel()
+
+	// GET_LOCK returns 1 on success and 0 on timeout; pg_advisory_lock
+	// blocks until the context is done and returns void.
+	var ok sql.NullInt64
+
+	if usesGetLock {
+		err = conn.QueryRowContext(lockCtx, acquire, args...).Scan(&ok)
+	} else {
+		_, err = conn.ExecContext(lockCtx, acquire, args...)
+	}
+
+	if err == nil && usesGetLock && ok.Int64 != 1 {
+		err = ErrLocked
+	}
+
+	if err != nil {
+		conn.Close()
+
+		if lockCtx.Err() == context.DeadlineExceeded {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	return func() error {
+		defer conn.Close()
+		_, err := conn.ExecContext(context.Background(), release, args[0])
+		return err
+	}, nil
+}
+
+// sqliteLock inserts the single row of the lock table, waiting while
+// another instance holds it. A process that dies while migrating leaves
+// the row behind; delete it from the lock table to migrate again.
+func (m *Migrator) sqliteLock(ctx context.Context) (func() error, error) {
+	d := m.DB.Dialect
+	table := d.QuoteField(m.table() + "_lock")
+
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s INTEGER PRIMARY KEY, %s TIMESTAMP NOT NULL)",
+		table, d.QuoteField("id"), d.QuoteField("locked_at"))
+
+	if _, err := database.ExecContext(ctx, m.DB, create); err != nil {
+		return nil, err
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES (1, CURRENT_TIMESTAMP)", table, d.QuoteField("id"), d.QuoteField("locked_at"))
+	deadline := time.Now().Add(m.lockTimeout())
+
+	for {
+		_, err := database.ExecContext(ctx, m.DB, insert)
+
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, database.ErrDuplicateKey) {
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrLocked
+		}
+
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() error {
+		_, err := database.ExecContext(context.Background(), m.DB, "DELETE FROM "+table)
+		return err
+	}, nil
+}
+
+// lockSeconds rounds d up to the whole seconds of GET_LOCK, at least
+// one, so that a sub-second timeout still waits instead of failing at
+// once.
+func lockSeconds(d time.Duration) int {
+	n := int((d + time.Second - 1) / time.Second)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func (m *Migrator) lockName() string {
+	return "migrate:" + m.table()
+}
+
+// lockKey derives the bigint key of the postgres advisory lock from the
+// lock name.
+func (m *Migrator) lockKey() int64 {
+	h := fnv.New64a()
+	h.Write([]byte(m.lockName()))
+	return int64(h.Sum64())
+}
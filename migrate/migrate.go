@@ -0,0 +1,484 @@
+// Package migrate applies numbered SQL migration scripts to a database
+// and records the applied versions in a bookkeeping table.
+//
+// Migrations are read from a directory of files named
+//
+//	<version>_<name>.up.sql
+//	<version>_<name>.down.sql
+//
+// where version is a positive integer. Scripts are executed with
+// database.MultiExec.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/simonklee/database"
+)
+
+var fileRe = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Migration is a single versioned schema change.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Checksum returns the hex encoded SHA-256 of the up script.
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// Load reads the migrations in dir ordered by version. Every version
+// must have an up script; down scripts are optional.
+func Load(dir string) ([]*Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+
+		parts := fileRe.FindStringSubmatch(fi.Name())
+
+		if parts == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(parts[1], 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("migrate: invalid version in %s: %v", fi.Name(), err)
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		} else if m.Name != parts[2] {
+			return nil, fmt.Errorf("migrate: version %d used by %s and %s", version, m.Name, parts[2])
+		}
+
+		if parts[3] == "up" {
+			m.Up = string(buf)
+		} else {
+			m.Down = string(buf)
+		}
+	}
+
+	list := make([]*Migration, 0, len(byVersion))
+
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migrate: missing up script for version %d", m.Version)
+		}
+		list = append(list, m)
+	}
+
+	sort.Sort(byVersionAsc(list))
+	return list, nil
+}
+
+type byVersionAsc []*Migration
+
+func (s byVersionAsc) Len() int           { return len(s) }
+func (s byVersionAsc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byVersionAsc) Less(i, j int) bool { return s[i].Version < s[j].Version }
+
+// ChecksumError is returned when the up script of an applied migration
+// has changed since it was applied.
+type ChecksumError struct {
+	Version  int64
+	Name     string
+	Applied  string
+	Computed string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("migrate: checksum mismatch for %d_%s: applied %s, file %s",
+		e.Version, e.Name, e.Applied, e.Computed)
+}
+
+// Status describes a migration found on disk or in the bookkeeping
+// table.
+type Status struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+
+	// Modified is set when the up script changed after it was applied.
+	Modified bool
+
+	// Missing is set when an applied version has no script on disk.
+	Missing bool
+}
+
+// Migrator applies the migrations in Dir to DB. Concurrent instances
+// wait for each other with a lock: an advisory lock held by a dedicated
+// connection on MySQL and Postgres, so DB must allow two open
+// connections, and a row of the table Table + "_lock" on SQLite.
+type Migrator struct {
+	DB  *database.DB
+	Dir string
+
+	// Table is the bookkeeping table. Defaults to "schema_migrations".
+	Table string
+
+	// LockTimeout bounds the wait for the migration lock held by
+	// another instance. Defaults to one minute.
+	LockTimeout time.Duration
+}
+
+// New returns a Migrator for the migrations in dir.
+func New(db *database.DB, dir string) *Migrator {
+	return &Migrator{DB: db, Dir: dir}
+}
+
+type appliedMigration struct {
+	Version   int64     `db:"version"`
+	Name      string    `db:"name"`
+	Checksum  string    `db:"checksum"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+func (m *Migrator) table() string {
+	if m.Table == "" {
+		return "schema_migrations"
+	}
+	return m.Table
+}
+
+func (m *Migrator) lockTimeout() time.Duration {
+	if m.LockTimeout <= 0 {
+		return time.Minute
+	}
+	return m.LockTimeout
+}
+
+// Up applies all pending migrations in order.
+func (m *Migrator) Up() error {
+	return m.locked(func(migrations []*Migration, applied map[int64]appliedMigration) error {
+		for _, mig := range migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			if err := m.apply(mig, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down reverts the n most recently applied migrations.
+func (m *Migrator) Down(n int) error {
+	return m.locked(func(migrations []*Migration, applied map[int64]appliedMigration) error {
+		return m.down(migrations, applied, n)
+	})
+}
+
+// Redo reverts the most recently applied migration and applies it
+// again.
+func (m *Migrator) Redo() error {
+	return m.locked(func(migrations []*Migration, applied map[int64]appliedMigration) error {
+		versions := appliedVersions(applied)
+
+		if len(versions) == 0 {
+			return nil
+		}
+
+		mig := findMigration(migrations, versions[len(versions)-1])
+
+		if mig == nil {
+			return fmt.Errorf("migrate: no script for applied version %d", versions[len(versions)-1])
+		}
+
+		if err := m.down(migrations, applied, 1); err != nil {
+			return err
+		}
+
+		return m.apply(mig, true)
+	})
+}
+
+// Status reports every migration found on disk or in the bookkeeping
+// table, ordered by version.
+func (m *Migrator) Status() ([]Status, error) {
+	migrations, err := Load(m.Dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.createTable(); err != nil {
+		return nil, err
+	}
+
+	applied, err := m.applied()
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Status, 0, len(migrations))
+
+	for _, mig := range migrations {
+		s := Status{Version: mig.Version, Name: mig.Name}
+
+		if a, ok := applied[mig.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = a.AppliedAt
+			s.Modified = a.Checksum != mig.Checksum()
+		}
+
+		list = append(list, s)
+	}
+
+	for _, v := range appliedVersions(applied) {
+		if findMigration(migrations, v) == nil {
+			a := applied[v]
+			list = append(list, Status{
+				Version:   v,
+				Name:      a.Name,
+				Applied:   true,
+				AppliedAt: a.AppliedAt,
+				Missing:   true,
+			})
+		}
+	}
+
+	sort.Sort(byStatusVersion(list))
+	return list, nil
+}
+
+type byStatusVersion []Status
+
+func (s byStatusVersion) Len() int           { return len(s) }
+func (s byStatusVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStatusVersion) Less(i, j int) bool { return s[i].Version < s[j].Version }
+
+// locked loads the migrations, takes the migration lock and verifies the
+// checksums of applied migrations before calling fn. An error releasing
+// the lock is joined with that of the migration.
+func (m *Migrator) locked(fn func([]*Migration, map[int64]appliedMigration) error) (err error) {
+	migrations, err := Load(m.Dir)
+
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	unlock, err := m.lock(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if uerr := unlock(); uerr != nil {
+			err = errors.Join(err, uerr)
+		}
+	}()
+
+	if err := m.createTable(); err != nil {
+		return err
+	}
+
+	applied, err := m.applied()
+
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range migrations {
+		a, ok := applied[mig.Version]
+
+		if ok && a.Checksum != mig.Checksum() {
+			return &ChecksumError{mig.Version, mig.Name, a.Checksum, mig.Checksum()}
+		}
+	}
+
+	return fn(migrations, applied)
+}
+
+func (m *Migrator) down(migrations []*Migration, applied map[int64]appliedMigration, n int) error {
+	versions := appliedVersions(applied)
+
+	for i := len(versions) - 1; i >= 0 && n > 0; i-- {
+		mig := findMigration(migrations, versions[i])
+
+		if mig == nil {
+			return fmt.Errorf("migrate: no script for applied version %d", versions[i])
+		}
+
+		if err := m.apply(mig, false); err != nil {
+			return err
+		}
+
+		delete(applied, mig.Version)
+		n--
+	}
+	return nil
+}
+
+// apply runs the up or down script of mig and updates the bookkeeping
+// table, inside a transaction when the engine supports transactional
+// DDL.
+func (m *Migrator) apply(mig *Migration, up bool) error {
+	script := mig.Up
+
+	if !up {
+		if mig.Down == "" {
+			return fmt.Errorf("migrate: missing down script for version %d", mig.Version)
+		}
+		script = mig.Down
+	}
+
+	if !transactionalDDL(m.DB.Dialect) {
+		if err := database.MultiExec(m.DB, script); err != nil {
+			return migrationError(mig, up, err)
+		}
+		return m.record(m.DB, mig, up)
+	}
+
+	tx, err := m.DB.Beginx()
+
+	if err != nil {
+		return err
+	}
+
+	if err := database.MultiExecDialect(m.DB.Dialect, tx, script); err != nil {
+		tx.Rollback()
+		return migrationError(mig, up, err)
+	}
+
+	if err := m.record(tx, mig, up); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func migrationError(mig *Migration, up bool, err error) error {
+	dir := "up"
+	if !up {
+		dir = "down"
+	}
+	return fmt.Errorf("migrate: %d_%s.%s.sql: %v", mig.Version, mig.Name, dir, err)
+}
+
+// transactionalDDL reports whether schema changes can be rolled back.
+// MySQL commits implicitly on every DDL statement.
+func transactionalDDL(d database.Dialect) bool {
+	switch d.(type) {
+	case database.MySQLDialect, *database.MySQLDialect:
+		return false
+	}
+	return true
+}
+
+func (m *Migrator) dbMap() *database.DbMap {
+	dbmap := database.NewDbMap(m.DB.Dialect)
+	t := dbmap.AddTableWithName(appliedMigration{}, m.table()).SetKeys(false, "Version")
+	t.ColMap("Name").SetMaxSize(255)
+	t.ColMap("Checksum").SetMaxSize(64)
+	return dbmap
+}
+
+func (m *Migrator) createTable() error {
+	return m.dbMap().CreateTablesIfNotExists(m.DB)
+}
+
+func (m *Migrator) applied() (map[int64]appliedMigration, error) {
+	d := m.DB.Dialect
+	q := fmt.Sprintf("SELECT %s, %s, %s, %s FROM %s",
+		d.QuoteField("version"), d.QuoteField("name"), d.QuoteField("checksum"),
+		d.QuoteField("applied_at"), d.QuoteField(m.table()))
+
+	var rows []appliedMigration
+
+	if err := database.Select(m.DB, &rows, q); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]appliedMigration, len(rows))
+
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+func (m *Migrator) record(conn database.Conn, mig *Migration, up bool) error {
+	d := m.DB.Dialect
+	var err error
+
+	if up {
+		q := fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s) VALUES (%s, %s, %s, %s)",
+			d.QuoteField(m.table()),
+			d.QuoteField("version"), d.QuoteField("name"), d.QuoteField("checksum"), d.QuoteField("applied_at"),
+			d.BindVar(0), d.BindVar(1), d.BindVar(2), d.BindVar(3))
+		_, err = database.Exec(conn, q, mig.Version, mig.Name, mig.Checksum(), time.Now().UTC())
+	} else {
+		q := fmt.Sprintf("DELETE FROM %s WHERE %s = %s",
+			d.QuoteField(m.table()), d.QuoteField("version"), d.BindVar(0))
+		_, err = database.Exec(conn, q, mig.Version)
+	}
+
+	return err
+}
+
+func appliedVersions(applied map[int64]appliedMigration) []int64 {
+	versions := make([]int64, 0, len(applied))
+
+	for v := range applied {
+		versions = append(versions, v)
+	}
+
+	sort.Sort(int64Slice(versions))
+	return versions
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+
+func findMigration(migrations []*Migration, version int64) *Migration {
+	for _, mig := range migrations {
+		if mig.Version == version {
+			return mig
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package migrate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/simonklee/database"
+)
+
+var scripts = map[string]string{
+	"0001_create_friend.up.sql":   "CREATE TABLE Friend (FriendID INTEGER PRIMARY KEY, Name TEXT);\n",
+	"0001_create_friend.down.sql": "DROP TABLE Friend;\n",
+	"0002_add_email.up.sql":       "ALTER TABLE Friend ADD COLUMN Email TEXT;\nCREATE INDEX FriendEmail ON Friend (Email);\n",
+	"0002_add_email.down.sql":     "DROP INDEX FriendEmail;\nALTER TABLE Friend DROP COLUMN Email;\n",
+	"README":                      "not a migration",
+}
+
+func setUp(t *testing.T) (*Migrator, func()) {
+	dir, err := ioutil.TempDir("", "migrate")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, body := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := database.NewSqliteDB(":memory:")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(db, dir), func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func appliedCount(t *testing.T, m *Migrator) int {
+	list, err := m.Status()
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	n := 0
+	for _, s := range list {
+		if s.Applied {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMigrator(t *testing.T) {
+	m, tearDown := setUp(t)
+	defer tearDown()
+
+	if err := m.Up(); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if n := appliedCount(t, m); n != 2 {
+		t.Fatalf("expected 2 got %d", n)
+	}
+
+	if _, err := database.Exec(m.DB, "INSERT INTO Friend (Name, Email) VALUES ('Foo', 'foo@example.com')"); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	// a second run has nothing to do
+	if err := m.Up(); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if err := m.Redo(); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if err := m.Down(1); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if n := appliedCount(t, m); n != 1 {
+		t.Fatalf("expected 1 got %d", n)
+	}
+
+	if err := m.Down(5); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if n := appliedCount(t, m); n != 0 {
+		t.Fatalf("expected 0 got %d", n)
+	}
+}
+
+func TestMigratorChecksum(t *testing.T) {
+	m, tearDown := setUp(t)
+	defer tearDown()
+
+	if err := m.Up(); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	name := filepath.Join(m.Dir, "0001_create_friend.up.sql")
+	if err := ioutil.WriteFile(name, []byte("CREATE TABLE Friend (FriendID INTEGER);\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := m.Status()
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if !list[0].Modified || list[1].Modified {
+		t.Fatalf("expected only version 1 modified got %+v", list)
+	}
+
+	if _, ok := m.Up().(*ChecksumError); !ok {
+		t.Fatalf("expected *ChecksumError")
+	}
+}
+
+func TestMigratorLock(t *testing.T) {
+	m, tearDown := setUp(t)
+	defer tearDown()
+
+	unlock, err := m.lock(context.Background())
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	m.LockTimeout = 100 * time.Millisecond
+
+	if err := m.Up(); err != ErrLocked {
+		t.Fatalf("expected ErrLocked got %v", err)
+	}
+
+	if err := unlock(); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if n := appliedCount(t, m); n != 2 {
+		t.Fatalf("expected 2 applied got %d", n)
+	}
+}
+
+func TestMigratorUnlockError(t *testing.T) {
+	m, tearDown := setUp(t)
+	defer tearDown()
+
+	err := m.locked(func([]*Migration, map[int64]appliedMigration) error {
+		_, err := m.DB.Exec(`DROP TABLE "schema_migrations_lock"`)
+		return err
+	})
+
+	if err == nil {
+		t.Fatalf("expected the error releasing the lock")
+	}
+}
+
+func TestLockSeconds(t *testing.T) {
+	for d, want := range map[time.Duration]int{
+		0:                       1,
+		100 * time.Millisecond:  1,
+		time.Second:             1,
+		1500 * time.Millisecond: 2,
+		time.Minute:             60,
+	} {
+		if got := lockSeconds(d); got != want {
+			t.Errorf("%v: expected %d got %d", d, want, got)
+		}
+	}
+}
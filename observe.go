@@ -0,0 +1,304 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// QueryEvent describes a statement run by a DB or one of its
+// transactions.
+type QueryEvent struct {
+	// Op is the operation the statement belongs to: insert, update,
+	// delete, get, select or upsert for the statements of the CRUD
+	// functions and Select, and exec or select for other statements.
+	Op string
+
+	// Table is the name of the table of Op, or "" if it is not known.
+	Table string
+
+	Query string
+
+	// Args are the arguments of the statement after redaction, see
+	// DB.Redact.
+	Args []interface{}
+
+	// Duration is the time until the statement returned. For queries it
+	// does not include reading the rows.
+	Duration time.Duration
+
+	// RowsAffected is the number of rows changed by an Exec, or -1 for
+	// queries and when the driver does not report it.
+	RowsAffected int64
+
+	// Err is the error of the statement, an *Error unless it is
+	// ErrNoRows or the error of ctx.
+	Err error
+}
+
+// QueryObserver is notified of every statement run by a DB, see
+// DB.Observer. This includes Exec, Queryx, QueryRowx, Select and the
+// statements of the CRUD functions. ObserveQuery is called after the
+// statement returns, on the calling goroutine.
+type QueryObserver interface {
+	ObserveQuery(ctx context.Context, e *QueryEvent)
+}
+
+// QueryObserverFunc adapts a function to a QueryObserver.
+type QueryObserverFunc func(ctx context.Context, e *QueryEvent)
+
+func (f QueryObserverFunc) ObserveQuery(ctx context.Context, e *QueryEvent) {
+	f(ctx, e)
+}
+
+type observers []QueryObserver
+
+func (o observers) ObserveQuery(ctx context.Context, e *QueryEvent) {
+	for _, obs := range o {
+		obs.ObserveQuery(ctx, e)
+	}
+}
+
+// Observers returns a QueryObserver notifying each of obs in turn.
+func Observers(obs ...QueryObserver) QueryObserver {
+	return observers(obs)
+}
+
+// Redactor rewrites the arguments of a statement before they are passed
+// to a QueryObserver. It must not modify args in place.
+type Redactor func(query string, args []interface{}) []interface{}
+
+// Redacted replaces redacted arguments.
+const Redacted = "[redacted]"
+
+// RedactAll hides all arguments.
+func RedactAll(query string, args []interface{}) []interface{} {
+	out := make([]interface{}, len(args))
+	for i := range out {
+		out[i] = Redacted
+	}
+	return out
+}
+
+// RedactColumns returns a Redactor hiding the arguments bound to the
+// named columns, which it recognizes in comparisons such as "col = ?" or
+// "col IN (?, ?)" and in the VALUES of INSERT statements with a column
+// list. Names are matched without regard to case and quoting.
+func RedactColumns(columns ...string) Redactor {
+	redact := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		redact[strings.ToLower(c)] = true
+	}
+
+	return func(query string, args []interface{}) []interface{} {
+		out := append([]interface{}(nil), args...)
+		for i, col := range argColumns(query, len(args)) {
+			if redact[col] {
+				out[i] = Redacted
+			}
+		}
+		return out
+	}
+}
+
+var (
+	// the column compared with the placeholder at the end of the text,
+	// with the second group set for the first placeholder of an IN list
+	comparedColRe = regexp.MustCompile(`(?i)([\w]+)["` + "`" + `\]]?\s*(?:=|<>|!=|<=|>=|<|>|\bLIKE|(\bIN\s*\())\s*$`)
+
+	insertColsRe = regexp.MustCompile(`(?is)^\s*(?:INSERT|REPLACE)\b[^(]*\(([^)]*)\)\s*VALUES\s*`)
+)
+
+// comparedColWindow bounds the text before a placeholder that is matched
+// against comparedColRe, so that statements with many placeholders are
+// scanned in linear time.
+const comparedColWindow = 128
+
+// argColumns returns the lower case name of the column each argument of
+// query is bound to, or "" if it is not known.
+func argColumns(query string, nargs int) []string {
+	cols := make([]string, nargs)
+
+	var insertCols []string
+	valuesAt := -1
+	if m := insertColsRe.FindStringSubmatchIndex(query); m != nil {
+		for _, c := range strings.Split(query[m[2]:m[3]], ",") {
+			insertCols = append(insertCols, strings.ToLower(strings.Trim(strings.TrimSpace(c), "\"`[]")))
+		}
+		valuesAt = m[1]
+	}
+
+	n := 0
+	depth, pos := 0, 0
+	var quote byte
+
+	// the column of the IN list at inDepth
+	inCol, inDepth := "", 0
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+			continue
+		case '(':
+			depth++
+			if depth == 1 {
+				pos = 0
+			}
+			continue
+		case ')':
+			if depth--; depth < inDepth {
+				inCol = ""
+			}
+			continue
+		case ',':
+			if depth == 1 {
+				pos++
+			}
+			continue
+		case '?', '$':
+		default:
+			continue
+		}
+
+		// a placeholder, "?" or "$n"
+		idx := n
+		if c == '$' {
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if j == i+1 {
+				continue
+			}
+			idx, _ = strconv.Atoi(query[i+1 : j])
+			idx--
+		}
+		n++
+
+		if idx < 0 || idx >= nargs {
+			continue
+		}
+
+		if valuesAt >= 0 && i >= valuesAt && depth == 1 && pos < len(insertCols) {
+			cols[idx] = insertCols[pos]
+			continue
+		}
+
+		if inCol != "" && depth == inDepth {
+			cols[idx] = inCol
+			continue
+		}
+
+		// the window starts on an identifier boundary
+		start := i - comparedColWindow
+		if start < 0 {
+			start = 0
+		}
+		for start > 0 && isIdentChar(query[start-1]) && query[start-1] != '$' {
+			start--
+		}
+
+		if m := comparedColRe.FindStringSubmatch(query[start:i]); m != nil {
+			cols[idx] = strings.ToLower(m[1])
+			if m[2] != "" {
+				inCol, inDepth = cols[idx], depth
+			}
+		}
+	}
+	return cols
+}
+
+// observe notifies the observer of db of a statement that started at
+// start. op is used unless ctx carries the operation, see withOp.
+func (db *DB) observe(ctx context.Context, op string, query string, args []interface{}, start time.Time, res sql.Result, err error) {
+	obs := db.Observer
+	if obs == nil {
+		return
+	}
+
+	e := &QueryEvent{
+		Op:           op,
+		Query:        query,
+		Args:         args,
+		Duration:     time.Since(start),
+		RowsAffected: -1,
+		Err:          err,
+	}
+
+	if info, ok := ctx.Value(opKey{}).(opInfo); ok {
+		e.Op, e.Table = info.op, info.table
+	}
+
+	e.Err = wrapError(ctx, db.Dialect, e.Op, e.Table, query, err)
+
+	if db.Redact != nil && len(args) > 0 {
+		e.Args = db.Redact(query, args)
+	}
+
+	if res != nil && err == nil {
+		if n, err := res.RowsAffected(); err == nil {
+			e.RowsAffected = n
+		}
+	}
+
+	obs.ObserveQuery(ctx, e)
+}
+
+// SlowQueryLogger is a QueryObserver logging the statements that take at
+// least Threshold, which may be zero to log every statement.
+type SlowQueryLogger struct {
+	Threshold time.Duration
+
+	// Sample logs only one of every Sample slow statements. Zero or one
+	// logs all of them.
+	Sample int
+
+	// Logger defaults to the standard logger.
+	Logger *log.Logger
+
+	n uint64
+}
+
+func (l *SlowQueryLogger) ObserveQuery(ctx context.Context, e *QueryEvent) {
+	if e.Duration < l.Threshold {
+		return
+	}
+
+	if l.Sample > 1 && (atomic.AddUint64(&l.n, 1)-1)%uint64(l.Sample) != 0 {
+		return
+	}
+
+	msg := fmt.Sprintf("query (%s", e.Duration)
+	if e.RowsAffected >= 0 {
+		msg += fmt.Sprintf(", %d rows", e.RowsAffected)
+	}
+	msg += "): " + e.Query
+	if len(e.Args) > 0 {
+		msg += fmt.Sprintf(" %v", e.Args)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	if l.Logger != nil {
+		l.Logger.Print(msg)
+	} else {
+		log.Print(msg)
+	}
+}
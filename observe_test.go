@@ -0,0 +1,114 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestObserver(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	var events []QueryEvent
+	db.Observer = QueryObserverFunc(func(ctx context.Context, e *QueryEvent) {
+		events = append(events, *e)
+	})
+	db.Redact = RedactColumns("Name")
+	defer func() { db.Observer, db.Redact = nil, nil }()
+
+	f := &Friend{Name: "secret"}
+
+	if err := Insert(db, f); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Name = "other"
+
+	if _, err := Update(db, f); err != nil {
+		t.Fatal(err)
+	}
+
+	var friends []Friend
+
+	if err := Select(db, &friends, "SELECT * FROM Friend WHERE Name = ? AND FriendID = ?", "other", f.FriendID); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events got %d", len(events))
+	}
+
+	for _, e := range events {
+		if e.Err != nil || e.Args[0] != Redacted || strings.Contains(e.Query, "secret") {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+
+	if e := events[1]; e.RowsAffected != 1 || !reflect.DeepEqual(e.Args[1:], []interface{}{f.FriendID}) {
+		t.Errorf("unexpected update event %+v", e)
+	}
+
+	if e := events[2]; e.RowsAffected != -1 || e.Args[1] != f.FriendID {
+		t.Errorf("unexpected select event %+v", e)
+	}
+}
+
+func TestArgColumns(t *testing.T) {
+	tests := []struct {
+		query string
+		nargs int
+		want  []string
+	}{
+		{
+			`INSERT INTO "Friend" ("FriendID","Name") VALUES (DEFAULT,$1),(DEFAULT,$2) RETURNING "FriendID";`,
+			2, []string{"name", "name"},
+		},
+		{
+			"UPDATE `Note` SET `Body`=?, `Version`=? WHERE `NoteID`=? AND `Version`=?;",
+			4, []string{"body", "version", "noteid", "version"},
+		},
+		{
+			`SELECT * FROM t WHERE a IN ($2, $1) AND lower(b) = ? AND c LIKE '?'`,
+			3, []string{"a", "a", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := argColumns(tt.query, tt.nargs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %v got %v", tt.query, tt.want, got)
+		}
+	}
+
+	// long IN lists map every placeholder to the column
+	const n = 20000
+	query := "SELECT * FROM t WHERE id IN (" + strings.Repeat("?, ", n-1) + "?) AND b = ?"
+	cols := argColumns(query, n+1)
+	if cols[0] != "id" || cols[n-1] != "id" || cols[n] != "b" {
+		t.Errorf("unexpected columns %v ... %v", cols[0], cols[n-1:])
+	}
+}
+
+func TestSlowQueryLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := &SlowQueryLogger{Sample: 2, Logger: log.New(buf, "", 0)}
+
+	for i := 0; i < 4; i++ {
+		l.ObserveQuery(context.Background(), &QueryEvent{Query: "SELECT 1", RowsAffected: -1})
+	}
+
+	if got := strings.Count(buf.String(), "SELECT 1"); got != 2 {
+		t.Fatalf("expected 2 sampled lines got %d: %s", got, buf)
+	}
+
+	l = &SlowQueryLogger{Threshold: 1 << 40, Logger: log.New(buf, "", 0)}
+	l.ObserveQuery(context.Background(), &QueryEvent{Query: "SELECT 2"})
+
+	if strings.Contains(buf.String(), "SELECT 2") {
+		t.Fatalf("expected fast query not logged")
+	}
+}
@@ -0,0 +1,259 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrInvalidCursor is returned by Paginator.Page for cursors that were
+// not issued with its Secret or that do not match its sort columns.
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// SortColumn is a column of the order of a Paginator, named by field or
+// column name.
+type SortColumn struct {
+	Column string
+	Desc   bool
+}
+
+// Paginator pages through the rows of a table in keyset order: instead of
+// an OFFSET, each page starts after the sort key of the last row of the
+// previous one, which the database can seek to with an index.
+//
+// The sort columns must identify a row, which is usually achieved by
+// ending them with the primary key, and must not be NULL.
+type Paginator struct {
+	Table *TableMap
+	Sort  []SortColumn
+
+	// Limit is the number of rows of a page.
+	Limit int
+
+	// Secret signs the cursors so that clients cannot forge them.
+	Secret []byte
+}
+
+// Page holds the cursors of the pages around the one returned by
+// Paginator.Page. A cursor is empty when there are no rows in its
+// direction.
+type Page struct {
+	Next string
+	Prev string
+}
+
+type cursor struct {
+	Prev   bool              `json:"p,omitempty"`
+	Sort   string            `json:"s"`
+	Values []json.RawMessage `json:"v"`
+}
+
+// Page selects the page of q identified by the cursor token, or the first
+// page for an empty token, into dest, a pointer to a slice of the table's struct
+// or of pointers to it. q must not be ordered or limited.
+func (p *Paginator) Page(conn Conn, q *SelectBuilder, token string, dest interface{}) (*Page, error) {
+	return p.PageContext(context.Background(), conn, q, token, dest)
+}
+
+func (p *Paginator) PageContext(ctx context.Context, conn Conn, q *SelectBuilder, token string, dest interface{}) (*Page, error) {
+	if p.Limit <= 0 || len(p.Sort) == 0 || len(p.Secret) == 0 {
+		return nil, fmt.Errorf("Paginator on table %s needs a Limit, Sort and Secret", p.Table.TableName)
+	}
+
+	if len(q.orderBy) > 0 || q.limit >= 0 || q.offset >= 0 {
+		return nil, fmt.Errorf("Paginator: query must not have ORDER BY, LIMIT or OFFSET")
+	}
+
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("Paginator: dest must be a pointer to a slice, got %T", dest)
+	}
+	rows := v.Elem()
+
+	cols := make([]*ColumnMap, len(p.Sort))
+	for i, s := range p.Sort {
+		if cols[i] = colMapOrNil(p.Table, s.Column); cols[i] == nil {
+			return nil, fmt.Errorf("Paginator: no column %s in table %s", s.Column, p.Table.TableName)
+		}
+	}
+
+	q = q.clone()
+	prev := false
+	if token != "" {
+		c, key, err := p.decode(token, cols)
+		if err != nil {
+			return nil, err
+		}
+		prev = c.Prev
+
+		cond, idx := p.seek(cols, prev)
+		args := make([]interface{}, len(idx))
+		for i, j := range idx {
+			args[i] = key[j]
+		}
+		q.And(cond, args...)
+	}
+
+	// the builder quotes the names in the dialect of conn
+	for i, s := range p.Sort {
+		desc := s.Desc != prev
+		order := ident(p.Table.TableName) + "." + ident(cols[i].ColumnName)
+		if desc {
+			order += " DESC"
+		}
+		q.OrderBy(order)
+	}
+	q.Limit(int64(p.Limit) + 1)
+
+	if err := q.SelectContext(ctx, conn, dest); err != nil {
+		return nil, err
+	}
+
+	more := rows.Len() > p.Limit
+	if more {
+		rows.Set(rows.Slice(0, p.Limit))
+	}
+
+	if prev {
+		swap := reflect.Swapper(rows.Interface())
+		for i, j := 0, rows.Len()-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+
+	page := &Page{}
+	if rows.Len() == 0 {
+		return page, nil
+	}
+
+	var err error
+	if more || prev {
+		if page.Next, err = p.encode(false, cols, reflect.Indirect(rows.Index(rows.Len()-1))); err != nil {
+			return nil, err
+		}
+	}
+	if (more && prev) || (!prev && token != "") {
+		if page.Prev, err = p.encode(true, cols, reflect.Indirect(rows.Index(0))); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// seek returns the condition selecting the rows after a sort key, or
+// before it if prev is true, and the index in the key of the value of
+// each of its placeholders:
+//
+//	(a > ?) OR (a = ? AND b > ?) OR ...
+func (p *Paginator) seek(cols []*ColumnMap, prev bool) (string, []int) {
+	var idx []int
+
+	s := bytes.Buffer{}
+	for i := range cols {
+		if i > 0 {
+			s.WriteString(" OR ")
+		}
+		s.WriteString("(")
+		for j := 0; j <= i; j++ {
+			if j > 0 {
+				s.WriteString(" AND ")
+			}
+			s.WriteString(ident(p.Table.TableName))
+			s.WriteString(".")
+			s.WriteString(ident(cols[j].ColumnName))
+
+			switch {
+			case j < i:
+				s.WriteString(" = ?")
+			case p.Sort[j].Desc != prev:
+				s.WriteString(" < ?")
+			default:
+				s.WriteString(" > ?")
+			}
+			idx = append(idx, j)
+		}
+		s.WriteString(")")
+	}
+	return s.String(), idx
+}
+
+func (p *Paginator) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// sortHash identifies the table and order of p so that a cursor is only
+// accepted by paginators with the same sort columns.
+func (p *Paginator) sortHash(cols []*ColumnMap) string {
+	h := sha256.New()
+	h.Write([]byte(p.Table.TableName))
+	for i, col := range cols {
+		dir := " ASC"
+		if p.Sort[i].Desc {
+			dir = " DESC"
+		}
+		h.Write([]byte("," + col.ColumnName + dir))
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:8])
+}
+
+func (p *Paginator) encode(prev bool, cols []*ColumnMap, elem reflect.Value) (string, error) {
+	c := cursor{Prev: prev, Sort: p.sortHash(cols)}
+	for _, col := range cols {
+		b, err := json.Marshal(col.value(elem).Interface())
+		if err != nil {
+			return "", err
+		}
+		c.Values = append(c.Values, b)
+	}
+
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(p.sign(payload)), nil
+}
+
+// decode verifies token and returns its cursor and sort key, converted
+// to the types of cols.
+func (p *Paginator) decode(token string, cols []*ColumnMap) (*cursor, []interface{}, error) {
+	enc := base64.RawURLEncoding
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, nil, ErrInvalidCursor
+	}
+
+	payload, err := enc.DecodeString(token[:i])
+	if err != nil {
+		return nil, nil, ErrInvalidCursor
+	}
+	sig, err := enc.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, p.sign(payload)) {
+		return nil, nil, ErrInvalidCursor
+	}
+
+	c := &cursor{}
+	if err := json.Unmarshal(payload, c); err != nil || c.Sort != p.sortHash(cols) || len(c.Values) != len(cols) {
+		return nil, nil, ErrInvalidCursor
+	}
+
+	key := make([]interface{}, len(cols))
+	for i, col := range cols {
+		v := reflect.New(col.gotype)
+		if err := json.Unmarshal(c.Values[i], v.Interface()); err != nil {
+			return nil, nil, ErrInvalidCursor
+		}
+		key[i] = v.Elem().Interface()
+	}
+	return c, key, nil
+}
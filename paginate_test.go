@@ -0,0 +1,95 @@
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPaginator(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	// names repeat so that the order falls back to the key
+	for _, name := range []string{"a", "b", "b", "c", "c", "c", "d"} {
+		if err := Insert(db, &Friend{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := DefaultDBMap.TableFor(Friend{})
+	p := &Paginator{
+		Table:  table,
+		Sort:   []SortColumn{{Column: "Name", Desc: true}, {Column: "FriendID"}},
+		Limit:  3,
+		Secret: []byte("secret"),
+	}
+	q := table.Query().Where("Name <> ?", "a")
+
+	ids := func(friends []*Friend) string {
+		s := make([]string, len(friends))
+		for i, f := range friends {
+			s[i] = f.Name + string(rune('0'+f.FriendID))
+		}
+		return strings.Join(s, ",")
+	}
+
+	var friends []*Friend
+	page, err := p.Page(db, q, "", &friends)
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	if got := ids(friends); got != "d7,c4,c5" || page.Prev != "" || page.Next == "" {
+		t.Fatalf("unexpected first page %s %+v", got, page)
+	}
+
+	friends = nil
+	page, err = p.Page(db, q, page.Next, &friends)
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	if got := ids(friends); got != "c6,b2,b3" || page.Prev == "" || page.Next != "" {
+		t.Fatalf("unexpected last page %s %+v", got, page)
+	}
+
+	friends = nil
+	page, err = p.Page(db, q, page.Prev, &friends)
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	if got := ids(friends); got != "d7,c4,c5" || page.Prev != "" || page.Next == "" {
+		t.Fatalf("unexpected previous page %s %+v", got, page)
+	}
+
+	// the query is not changed by paging
+	if _, _, err := q.ToSql(); err != nil || len(q.orderBy) != 0 {
+		t.Fatalf("query was modified")
+	}
+
+	tampered := []byte(page.Next)
+	tampered[0] ^= 1
+
+	for _, token := range []string{"x", string(tampered)} {
+		if _, err := p.Page(db, q, token, &friends); err != ErrInvalidCursor {
+			t.Errorf("expected ErrInvalidCursor got %v", err)
+		}
+	}
+
+	// a cursor only pages in the order it was issued for
+	for _, sort := range [][]SortColumn{
+		{{Column: "Name"}, {Column: "FriendID"}},
+		{{Column: "FriendID", Desc: true}, {Column: "FriendID"}},
+	} {
+		other := *p
+		other.Sort = sort
+		if _, err := other.Page(db, q, page.Next, &friends); err != ErrInvalidCursor {
+			t.Errorf("%v: expected ErrInvalidCursor got %v", sort, err)
+		}
+	}
+
+	other := *p
+	other.Sort = []SortColumn{{Column: "Missing"}}
+	if _, err := other.Page(db, q, "", &friends); err == nil || err == ErrInvalidCursor {
+		t.Errorf("expected an unknown column error got %v", err)
+	}
+}
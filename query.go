@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"reflect"
@@ -48,22 +49,28 @@ func PrepareWhere(w []string) string {
 	return " WHERE " + strings.Join(w, " AND ")
 }
 
+// PrepareIN returns n comma separated bind variables using the dialect
+// of DefaultDBMap. Use DbMap.PrepareIN when the bind variables are
+// numbered and do not start at the first argument.
 func PrepareIN(n int) string {
-	return strings.Repeat("?, ", n-1) + "?"
+	return DefaultDBMap.PrepareIN(0, n)
 }
 
+// PrepareIntIN appends a condition on table.field for an int or []int
+// value. The names are not quoted; TableMap.Filters covers other types
+// and operators.
 func PrepareIntIN(args *[]interface{}, w *[]string, value interface{}, table, field string) error {
 	switch v := value.(type) {
 	case []int:
 		if len(v) == 0 {
 			break
 		}
-		inPart := PrepareIN(len(v))
+		inPart := DefaultDBMap.PrepareIN(len(*args), len(v))
 		*w = append(*w, fmt.Sprintf("%s.%s IN (%s)", table, field, inPart))
 		*args = append(*args, intToIface(v)...)
 	case int:
+		*w = append(*w, fmt.Sprintf("%s.%s = %s", table, field, BindVar(len(*args))))
 		*args = append(*args, v)
-		*w = append(*w, fmt.Sprintf("%s.%s = ?", table, field))
 	default:
 		err := fmt.Errorf("expected %s type int or []int, got %T", field, v)
 		return err
@@ -72,7 +79,11 @@ func PrepareIntIN(args *[]interface{}, w *[]string, value interface{}, table, fi
 }
 
 func Scalar(conn Conn, query string, args ...interface{}) (int64, error) {
-	row, err := QueryRowx(conn, query, args...)
+	return ScalarContext(context.Background(), conn, query, args...)
+}
+
+func ScalarContext(ctx context.Context, conn Conn, query string, args ...interface{}) (int64, error) {
+	row, err := QueryRowxContext(ctx, conn, query, args...)
 
 	if err != nil {
 		return 0, err
@@ -80,17 +91,25 @@ func Scalar(conn Conn, query string, args ...interface{}) (int64, error) {
 
 	var value int64
 	err = row.Scan(&value)
-	return value, err
+	return value, wrapError(ctx, connDialect(DefaultDBMap, conn), opSelect, "", query, err)
 }
 
+// Prepare returns a prepared statement for query, which must be handed
+// back with StmtClose. A *DB with a statement cache, see
+// DB.SetStmtCacheSize, returns its cached statement.
 func Prepare(conn Conn, query string) (*sqlx.Stmt, error) {
+	return PrepareContext(context.Background(), conn, query)
+}
+
+func PrepareContext(ctx context.Context, conn Conn, query string) (*sqlx.Stmt, error) {
 	switch c := conn.(type) {
-	case *sqlx.Tx:
-		return c.Preparex(query)
 	case *DB:
-		return c.stmtCache.get(conn, query)
+		if c.stmtCache.enabled() {
+			return c.stmtCache.get(ctx, c, query, true)
+		}
+		return c.PreparexContext(ctx, query)
 	default:
-		return c.Preparex(query)
+		return c.PreparexContext(ctx, query)
 	}
 }
 
@@ -99,72 +118,108 @@ func StmtClose(conn Conn, stmt *sqlx.Stmt) error {
 		return nil
 	}
 
-	switch conn.(type) {
-	case *DB:
+	if c, ok := conn.(*DB); ok && c.stmtCache.release(stmt) {
 		return nil
-	default:
-		return stmt.Close()
 	}
+	return stmt.Close()
 }
 
 func Exec(conn Conn, query string, args ...interface{}) (sql.Result, error) {
-	return conn.Exec(query, args...)
-	// if stmt, err := Prepare(conn, query); err != nil {
-	// 	return nil, err
-	// } else {
-	// 	defer StmtClose(conn, stmt)
-	// 	return stmt.Exec(args...)
-	// }
+	return ExecContext(context.Background(), conn, query, args...)
+}
+
+func ExecContext(ctx context.Context, conn Conn, query string, args ...interface{}) (sql.Result, error) {
+	res, err := conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapError(ctx, connDialect(DefaultDBMap, conn), opExec, "", query, err)
+	}
+	return res, nil
 }
 
 func Queryx(conn Conn, query string, args ...interface{}) (*sqlx.Rows, error) {
-	return conn.Queryx(query, args...)
-	//if stmt, err := Prepare(conn, query); err != nil {
-	//	return nil, err
-	//} else {
-	//	defer StmtClose(conn, stmt)
-	//	return stmt.Queryx(args...)
-	//}
+	return QueryxContext(context.Background(), conn, query, args...)
+}
+
+func QueryxContext(ctx context.Context, conn Conn, query string, args ...interface{}) (*sqlx.Rows, error) {
+	rows, err := conn.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapError(ctx, connDialect(DefaultDBMap, conn), opSelect, "", query, err)
+	}
+	return rows, nil
 }
 
 func QueryRowx(conn Conn, query string, args ...interface{}) (*sqlx.Row, error) {
-	return conn.QueryRowx(query, args...), nil
-	//stmt, err := Prepare(conn, query)
-	//defer StmtClose(conn, stmt)
+	return QueryRowxContext(context.Background(), conn, query, args...)
+}
 
-	//if err != nil {
-	//	fmt.Println("ERR", err)
-	//	return nil, err
-	//} else {
-	//	return stmt.QueryRowx(args...), nil
-	//}
+// QueryRowxContext runs query and returns its first row. An error
+// running the query is returned wrapped in an *Error; the Scan methods of
+// the row report it unwrapped, like errors that only occur while reading
+// the row. ScalarContext wraps both.
+func QueryRowxContext(ctx context.Context, conn Conn, query string, args ...interface{}) (*sqlx.Row, error) {
+	row := conn.QueryRowxContext(ctx, query, args...)
+	if err := row.Err(); err != nil {
+		return row, wrapError(ctx, connDialect(DefaultDBMap, conn), opSelect, "", query, err)
+	}
+	return row, nil
 }
 
 func Select(exec Conn, dest interface{}, query string, args ...interface{}) error {
-	return querySelect(DefaultDBMap, exec, dest, query, args...)
+	return SelectContext(context.Background(), exec, dest, query, args...)
+}
+
+func SelectContext(ctx context.Context, exec Conn, dest interface{}, query string, args ...interface{}) error {
+	return querySelect(ctx, DefaultDBMap, exec, dest, query, args...)
+}
+
+// Get loads the row with the given primary key values into dest, a
+// pointer to a struct registered with DefaultDBMap. The keys are given in
+// the order passed to SetKeys. ErrNoRows is returned if no row matches.
+func Get(exec Conn, dest interface{}, keys ...interface{}) error {
+	return GetContext(context.Background(), exec, dest, keys...)
+}
+
+func GetContext(ctx context.Context, exec Conn, dest interface{}, keys ...interface{}) error {
+	return queryGet(ctx, DefaultDBMap, exec, dest, keys...)
 }
 
 func Put(exec Conn, isNew bool, list ...interface{}) error {
+	return PutContext(context.Background(), exec, isNew, list...)
+}
+
+func PutContext(ctx context.Context, exec Conn, isNew bool, list ...interface{}) error {
 	if isNew {
-		return Insert(exec, list...)
+		return InsertContext(ctx, exec, list...)
 	}
-	_, err := Update(exec, list...)
+	_, err := UpdateContext(ctx, exec, list...)
 	return err
 }
 
 func Update(exec Conn, list ...interface{}) (int64, error) {
-	return queryUpdate(DefaultDBMap, exec, list...)
+	return UpdateContext(context.Background(), exec, list...)
+}
+
+func UpdateContext(ctx context.Context, exec Conn, list ...interface{}) (int64, error) {
+	return queryUpdate(ctx, DefaultDBMap, exec, list...)
 }
 
 func Insert(exec Conn, list ...interface{}) error {
-	return queryInsert(DefaultDBMap, exec, list...)
+	return InsertContext(context.Background(), exec, list...)
+}
+
+func InsertContext(ctx context.Context, exec Conn, list ...interface{}) error {
+	return queryInsert(ctx, DefaultDBMap, exec, list...)
 }
 
 func Delete(exec Conn, list ...interface{}) (int64, error) {
-	return queryDelete(DefaultDBMap, exec, list...)
+	return DeleteContext(context.Background(), exec, list...)
+}
+
+func DeleteContext(ctx context.Context, exec Conn, list ...interface{}) (int64, error) {
+	return queryDelete(ctx, DefaultDBMap, exec, list...)
 }
 
-func querySelect(m *DbMap, exec Conn, dest interface{}, query string, args ...interface{}) error {
+func querySelect(ctx context.Context, m *DbMap, exec Conn, dest interface{}, query string, args ...interface{}) error {
 	t := reflect.TypeOf(dest)
 
 	if t.Kind() == reflect.Ptr {
@@ -173,32 +228,65 @@ func querySelect(m *DbMap, exec Conn, dest interface{}, query string, args ...in
 		return fmt.Errorf("select dest must be a pointer, but got: %t", dest)
 	}
 
-	//stmt, err := Prepare(exec, query)
-	//defer StmtClose(exec, stmt)
+	tableName := ""
+	if table := m.TableFor(dest); table != nil {
+		tableName = table.TableName
+		ctx = withOp(ctx, opSelect, tableName)
+	}
 
-	//if err != nil {
-	//	return err
-	//}
+	d := connDialect(m, exec)
 
 	switch t.Kind() {
 	case reflect.Struct:
-		//row := stmt.QueryRowx(args...)
-		row := exec.QueryRowx(query, args...)
-		return row.StructScan(dest)
+		row := exec.QueryRowxContext(ctx, query, args...)
+		if err := row.StructScan(dest); err != nil {
+			return wrapError(ctx, d, opSelect, tableName, query, err)
+		}
+		takeSnapshots(m, dest)
+		return runPostGet(exec, dest)
 	case reflect.Slice:
-		//sqlrows, err := stmt.Query(args...)
-		sqlrows, err := exec.Query(query, args...)
+		sqlrows, err := exec.QueryContext(ctx, query, args...)
 		if err != nil {
-			return err
+			return wrapError(ctx, d, opSelect, tableName, query, err)
 		}
 		defer sqlrows.Close()
-		return sqlx.StructScan(sqlrows, dest)
+		if err := sqlx.StructScan(sqlrows, dest); err != nil {
+			return wrapError(ctx, d, opSelect, tableName, query, err)
+		}
+		takeSnapshots(m, dest)
+		return runPostGet(exec, dest)
 	default:
 		return fmt.Errorf("select dest must be a pointer to a slice or struct, but got: %t", dest)
 	}
 }
 
-func queryDelete(m *DbMap, exec Conn, list ...interface{}) (int64, error) {
+func queryGet(ctx context.Context, m *DbMap, exec Conn, dest interface{}, keys ...interface{}) error {
+	m = m.forConn(exec)
+
+	table, elem, err := tableForPointer(m, dest, true)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) != len(table.keys) {
+		return fmt.Errorf("Get on table %s needs %d keys, but got %d", table.TableName, len(table.keys), len(keys))
+	}
+
+	plan := table.bindGet()
+	row := exec.QueryRowxContext(withOp(ctx, opGet, table.TableName), plan.query, keys...)
+
+	if err := row.StructScan(dest); err != nil {
+		return wrapError(ctx, connDialect(m, exec), opGet, table.TableName, plan.query, err)
+	}
+
+	table.takeSnapshot(elem)
+
+	return runPostGet(exec, dest)
+}
+
+func queryDelete(ctx context.Context, m *DbMap, exec Conn, list ...interface{}) (int64, error) {
+	m = m.forConn(exec)
+
 	var err error
 	var table *TableMap
 	var elem reflect.Value
@@ -210,19 +298,18 @@ func queryDelete(m *DbMap, exec Conn, list ...interface{}) (int64, error) {
 			return -1, err
 		}
 
+		if v, ok := ptr.(PreDeleter); ok {
+			if err := v.PreDelete(exec); err != nil {
+				return -1, err
+			}
+		}
+
 		bi := table.bindDelete(elem)
-		//stmt, err := Prepare(exec, bi.query)
-		//defer StmtClose(exec, stmt)
-		//
-		//f err != nil {
-		//	return -1, err
-		//}
 
-		//res, err := stmt.Exec(bi.args...)
-		res, err := exec.Exec(bi.query, bi.args...)
+		res, err := exec.ExecContext(withOp(ctx, opDelete, table.TableName), bi.query, bi.args...)
 
 		if err != nil {
-			return -1, err
+			return -1, wrapError(ctx, connDialect(m, exec), opDelete, table.TableName, bi.query, err)
 		}
 
 		rows, err := res.RowsAffected()
@@ -230,54 +317,155 @@ func queryDelete(m *DbMap, exec Conn, list ...interface{}) (int64, error) {
 			return -1, err
 		}
 
+		if v, ok := ptr.(PostDeleter); ok {
+			if err := v.PostDelete(exec); err != nil {
+				return -1, err
+			}
+		}
+
 		count += rows
 	}
 
 	return count, nil
 }
 
-func queryUpdate(m *DbMap, exec Conn, list ...interface{}) (int64, error) {
-	var err error
-	var table *TableMap
-	var elem reflect.Value
+func queryUpdate(ctx context.Context, m *DbMap, exec Conn, list ...interface{}) (int64, error) {
+	m = m.forConn(exec)
+
 	var count int64
 
 	for _, ptr := range list {
-		table, elem, err = tableForPointer(m, ptr, true)
+		table, elem, err := tableForPointer(m, ptr, true)
 		if err != nil {
 			return -1, err
 		}
 
-		bi := table.bindUpdate(elem)
+		rows, err := execUpdate(ctx, exec, table, elem, ptr, nil)
 		if err != nil {
 			return -1, err
 		}
 
-		// stmt, err := Prepare(exec, bi.query)
-		// defer StmtClose(exec, stmt)
+		count += rows
+	}
+	return count, nil
+}
 
-		// if err != nil {
-		// 	return -1, err
-		// }
+// execUpdate runs the update hooks and the UPDATE of the given columns of
+// a single element, or of all columns if cols is nil.
+func execUpdate(ctx context.Context, exec Conn, table *TableMap, elem reflect.Value, ptr interface{}, cols []*ColumnMap) (int64, error) {
+	if v, ok := ptr.(PreUpdater); ok {
+		if err := v.PreUpdate(exec); err != nil {
+			return -1, err
+		}
+	}
 
-		// res, err := stmt.Exec(bi.args...)
-		res, err := exec.Exec(bi.query, bi.args...)
+	if cols == nil {
+		cols = table.changedColumns(elem)
 
-		if err != nil {
-			return -1, err
+		if cols != nil && len(cols) == 0 {
+			return 0, nil
 		}
+	}
 
-		rows, err := res.RowsAffected()
-		if err != nil {
+	var bi bindInstance
+	if cols == nil {
+		bi = table.bindUpdate(elem)
+	} else {
+		bi = table.bindUpdateColumns(elem, cols)
+	}
+
+	res, err := exec.ExecContext(withOp(ctx, opUpdate, table.TableName), bi.query, bi.args...)
+
+	if err != nil {
+		return -1, wrapError(ctx, connDialect(table.dbmap, exec), opUpdate, table.TableName, bi.query, err)
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+
+	if bi.versCol != nil {
+		if rows == 0 {
+			return -1, &OptimisticLockError{table.TableName, bi.keys, bi.existingVersion}
+		}
+		bi.versCol.field(elem).SetInt(bi.existingVersion + 1)
+	}
+
+	table.updateSnapshot(elem, cols)
+
+	if v, ok := ptr.(PostUpdater); ok {
+		if err := v.PostUpdate(exec); err != nil {
 			return -1, err
 		}
+	}
 
-		count += rows
+	return rows, nil
+}
+
+// UpdateColumns updates only the named columns of the row of ptr. Names
+// are struct field or column names; keys, transient and unknown columns
+// are rejected.
+func UpdateColumns(exec Conn, ptr interface{}, names ...string) (int64, error) {
+	return UpdateColumnsContext(context.Background(), exec, ptr, names...)
+}
+
+func UpdateColumnsContext(ctx context.Context, exec Conn, ptr interface{}, names ...string) (int64, error) {
+	return queryUpdateColumns(ctx, DefaultDBMap, exec, ptr, false, names)
+}
+
+// UpdateColumnsExcept updates all columns of the row of ptr except the
+// named ones.
+func UpdateColumnsExcept(exec Conn, ptr interface{}, names ...string) (int64, error) {
+	return UpdateColumnsExceptContext(context.Background(), exec, ptr, names...)
+}
+
+func UpdateColumnsExceptContext(ctx context.Context, exec Conn, ptr interface{}, names ...string) (int64, error) {
+	return queryUpdateColumns(ctx, DefaultDBMap, exec, ptr, true, names)
+}
+
+func queryUpdateColumns(ctx context.Context, m *DbMap, exec Conn, ptr interface{}, except bool, names []string) (int64, error) {
+	m = m.forConn(exec)
+
+	table, elem, err := tableForPointer(m, ptr, true)
+	if err != nil {
+		return -1, err
 	}
-	return count, nil
+
+	named := make(map[*ColumnMap]bool, len(names))
+	for _, name := range names {
+		col := colMapOrNil(table, name)
+		switch {
+		case col == nil:
+			return -1, fmt.Errorf("No column %s in table %s", name, table.TableName)
+		case except:
+		case col.isPK:
+			return -1, fmt.Errorf("Cannot update key column %s in table %s", name, table.TableName)
+		case col.Transient:
+			return -1, fmt.Errorf("Cannot update transient column %s in table %s", name, table.TableName)
+		case col.ReadOnly:
+			return -1, fmt.Errorf("Cannot update read-only column %s in table %s", name, table.TableName)
+		}
+		named[col] = true
+	}
+
+	cols := make([]*ColumnMap, 0, len(table.columns))
+	for _, col := range table.columns {
+		if !col.isPK && !col.Transient && !col.ReadOnly && col != table.version && named[col] != except {
+			cols = append(cols, col)
+		}
+	}
+
+	if len(cols) == 0 && table.version == nil {
+		return -1, fmt.Errorf("No columns to update in table %s", table.TableName)
+	}
+
+	return execUpdate(ctx, exec, table, elem, ptr, cols)
 }
 
-func queryInsert(m *DbMap, exec Conn, list ...interface{}) error {
+func queryInsert(ctx context.Context, m *DbMap, exec Conn, list ...interface{}) error {
+	m = m.forConn(exec)
+
 	var err error
 	var table *TableMap
 	var elem reflect.Value
@@ -288,44 +476,58 @@ func queryInsert(m *DbMap, exec Conn, list ...interface{}) error {
 			return err
 		}
 
-		bi := table.bindInsert(elem)
-		//stmt, err := Prepare(exec, bi.query)
-		//defer StmtClose(exec, stmt)
-
-		//if err != nil {
-		//	return err
-		//}
-
-		if bi.autoIncrIdx > -1 {
-			//res, err := stmt.Exec(bi.args...)
-			res, err := exec.Exec(bi.query, bi.args...)
-
-			if err != nil {
+		if v, ok := ptr.(PreInserter); ok {
+			if err := v.PreInsert(exec); err != nil {
 				return err
 			}
+		}
 
-			id, err := res.LastInsertId()
+		if table.version != nil {
+			table.version.field(elem).SetInt(1)
+		}
+
+		bi := table.bindInsert(elem)
+		opCtx := withOp(ctx, opInsert, table.TableName)
+
+		if bi.autoIncrIdx > -1 {
+			id, err := m.dialect().InsertAutoIncr(opCtx, exec, bi.query, bi.args...)
 
 			if err != nil {
-				return err
+				return wrapError(ctx, connDialect(m, exec), opInsert, table.TableName, bi.query, err)
 			}
 
-			f := elem.Field(bi.autoIncrIdx)
-			k := f.Kind()
-
-			if (k == reflect.Int) || (k == reflect.Int16) || (k == reflect.Int32) || (k == reflect.Int64) {
-				f.SetInt(id)
-			} else {
+			if !setAutoIncr(table.columns[bi.autoIncrIdx].field(elem), id) {
 				return fmt.Errorf("Cannot set autoincrement value on non-Int field. SQL=%s  autoIncrIdx=%d", bi.query, bi.autoIncrIdx)
 			}
 		} else {
-			//_, err := stmt.Exec(bi.args...)
-			_, err := exec.Exec(bi.query, bi.args...)
+			_, err := exec.ExecContext(opCtx, bi.query, bi.args...)
 
 			if err != nil {
+				return wrapError(ctx, connDialect(m, exec), opInsert, table.TableName, bi.query, err)
+			}
+		}
+
+		table.takeSnapshot(elem)
+
+		if v, ok := ptr.(PostInserter); ok {
+			if err := v.PostInsert(exec); err != nil {
 				return err
 			}
 		}
 	}
 	return nil
 }
+
+// setAutoIncr sets the integer field f to id and reports whether f is an
+// integer.
+func setAutoIncr(f reflect.Value, id int64) bool {
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f.SetInt(id)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f.SetUint(uint64(id))
+	default:
+		return false
+	}
+	return true
+}
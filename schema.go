@@ -1,10 +1,10 @@
 package database
 
 import (
+	"fmt"
 	"io/ioutil"
 	"path"
 	"runtime"
-	"strings"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -21,17 +21,49 @@ func MultiExecFromFile(e sqlx.Execer, filename string) error {
 	return MultiExec(e, string(buf))
 }
 
+// MultiExec splits query into statements with SplitStatements and
+// executes them in order. The dialect is that of e if it is a *DB or
+// *Tx, and that of DefaultDBMap otherwise. Execution stops at the first
+// failing statement, which is reported as a *StatementError.
 func MultiExec(e sqlx.Execer, query string) error {
-	stmts := strings.Split(query, ";\n")
+	d := DefaultDBMap.dialect()
+	if c, ok := e.(Conn); ok {
+		d = connDialect(DefaultDBMap, c)
+	}
+
+	return MultiExecDialect(d, e, query)
+}
 
-	if len(strings.Trim(stmts[len(stmts)-1], " \n\t\r")) == 0 {
-		stmts = stmts[:len(stmts)-1]
+// MultiExecDialect is MultiExec splitting query with dialect d, for
+// executers such as *sqlx.Tx that do not carry a dialect.
+func MultiExecDialect(d Dialect, e sqlx.Execer, query string) error {
+	stmts, err := SplitStatements(d, query)
+
+	if err != nil {
+		return err
 	}
 
-	for _, s := range stmts {
-		if _, err := e.Exec(s); err != nil {
-			return err
+	for i, s := range stmts {
+		if _, err := e.Exec(s.SQL); err != nil {
+			return &StatementError{Index: i, Line: s.Line, SQL: s.SQL, Err: err}
 		}
 	}
 	return nil
 }
+
+// StatementError is returned by MultiExec when a statement of a script
+// fails.
+type StatementError struct {
+	// Index is the 0-based position of the statement in the script.
+	Index int
+
+	// Line is the 1-based line on which the statement starts.
+	Line int
+
+	SQL string
+	Err error
+}
+
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("statement %d at line %d: %v", e.Index+1, e.Line, e.Err)
+}
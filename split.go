@@ -0,0 +1,237 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Statement is a single statement of a SQL script.
+type Statement struct {
+	SQL string
+
+	// Line is the 1-based line on which the statement starts.
+	Line int
+}
+
+// SplitStatements splits a SQL script for dialect d into statements.
+// Delimiters inside quoted strings, backtick or double quoted
+// identifiers, postgres dollar quoted bodies and comments ("--" and
+// "/* */") are ignored. A nil d is MySQL.
+//
+// The lexical rules follow the dialect. For MySQL, "#" starts a comment,
+// "--" only does when followed by whitespace, and backslash escapes are
+// honoured in quoted strings. The MySQL client's "DELIMITER xx" directive
+// changes the delimiter for the following statements, which allows stored
+// procedure bodies to contain ";". For Postgres, backslash escapes are
+// only honoured in E'...' strings, and SQLite has none.
+//
+// Statements consisting only of comments are dropped, except for MySQL
+// executable comments ("/*! */").
+func SplitStatements(d Dialect, script string) ([]Statement, error) {
+	var stmts []Statement
+
+	var mysql, postgres bool
+	switch d.(type) {
+	case nil, MySQLDialect, *MySQLDialect:
+		mysql = true
+	case PostgresDialect, *PostgresDialect:
+		postgres = true
+	}
+
+	delim := ";"
+	line := 1
+	start := -1
+	startLine := 0
+	lineStart := true
+	n := len(script)
+
+	for i := 0; i < n; {
+		c := script[i]
+
+		if mysql && start < 0 && lineStart && isDelimiterDirective(script[i:]) {
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = n
+			} else {
+				end += i
+			}
+
+			fields := strings.Fields(script[i+len("delimiter") : end])
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("line %d: DELIMITER without a delimiter", line)
+			}
+
+			delim = fields[0]
+			i = end
+			continue
+		}
+
+		if strings.HasPrefix(script[i:], delim) {
+			if start >= 0 {
+				stmts = append(stmts, Statement{strings.TrimSpace(script[start:i]), startLine})
+				start = -1
+			}
+			i += len(delim)
+			lineStart = false
+			continue
+		}
+
+		switch {
+		case c == '\n':
+			line++
+			lineStart = true
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+			continue
+		case mysql && c == '#', isDashComment(script[i:], mysql):
+			if end := strings.IndexByte(script[i:], '\n'); end < 0 {
+				i = n
+			} else {
+				i += end
+			}
+			lineStart = false
+			continue
+		case strings.HasPrefix(script[i:], "/*") && !strings.HasPrefix(script[i:], "/*!"):
+			end, err := skipBlockComment(script, i, line)
+			if err != nil {
+				return nil, err
+			}
+			line += strings.Count(script[i:end], "\n")
+			i = end
+			lineStart = false
+			continue
+		}
+
+		if start < 0 {
+			start = i
+			startLine = line
+		}
+		lineStart = false
+
+		var end int
+		var err error
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end, err = skipQuoted(script, i, line, mysql && c != '`')
+		case postgres && (c == 'E' || c == 'e') && i+1 < n && script[i+1] == '\'' && (i == 0 || !isIdentChar(script[i-1])):
+			end, err = skipQuoted(script, i+1, line, true)
+		case postgres && c == '$' && (i == 0 || !isIdentChar(script[i-1])):
+			end, err = skipDollarQuoted(script, i, line)
+		case strings.HasPrefix(script[i:], "/*!"):
+			end, err = skipBlockComment(script, i, line)
+		default:
+			end = i + 1
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		line += strings.Count(script[i:end], "\n")
+		i = end
+	}
+
+	if start >= 0 {
+		stmts = append(stmts, Statement{strings.TrimSpace(script[start:]), startLine})
+	}
+
+	return stmts, nil
+}
+
+// isDashComment reports whether s starts with a "--" comment. MySQL
+// requires whitespace or the end of the line after the dashes, so that
+// "1--1" is an expression.
+func isDashComment(s string, mysql bool) bool {
+	if !strings.HasPrefix(s, "--") {
+		return false
+	}
+	if !mysql || len(s) == 2 {
+		return true
+	}
+
+	switch s[2] {
+	case ' ', '\t', '\n', '\r', '\f', '\v':
+		return true
+	}
+	return false
+}
+
+func isDelimiterDirective(s string) bool {
+	const directive = "delimiter"
+
+	if len(s) <= len(directive) || !strings.EqualFold(s[:len(directive)], directive) {
+		return false
+	}
+
+	c := s[len(directive)]
+	return c == ' ' || c == '\t'
+}
+
+// skipBlockComment returns the offset following the comment that starts
+// at i.
+func skipBlockComment(s string, i, line int) (int, error) {
+	end := strings.Index(s[i+2:], "*/")
+	if end < 0 {
+		return 0, fmt.Errorf("line %d: unterminated comment", line)
+	}
+	return i + 2 + end + 2, nil
+}
+
+// skipQuoted returns the offset following the quoted string or
+// identifier that starts at i. A doubled quote character is an escaped
+// quote, and so is a backslash escaped one if backslash is true.
+func skipQuoted(s string, i, line int, backslash bool) (int, error) {
+	q := s[i]
+
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			if backslash {
+				j++
+			}
+		case q:
+			if j+1 < len(s) && s[j+1] == q {
+				j++
+				continue
+			}
+			return j + 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("line %d: unterminated quoted string %c", line, q)
+}
+
+// skipDollarQuoted returns the offset following the postgres dollar
+// quoted string ($$...$$ or $tag$...$tag$) that starts at i. A "$" that
+// does not start a dollar quote, such as a $1 bind variable, is skipped
+// on its own.
+func skipDollarQuoted(s string, i, line int) (int, error) {
+	j := i + 1
+	for j < len(s) && (s[j] == '_' || isLetter(s[j]) || (j > i+1 && s[j] >= '0' && s[j] <= '9')) {
+		j++
+	}
+
+	if j >= len(s) || s[j] != '$' {
+		return i + 1, nil
+	}
+
+	tag := s[i : j+1]
+	end := strings.Index(s[j+1:], tag)
+
+	if end < 0 {
+		return 0, fmt.Errorf("line %d: unterminated dollar quoted string %s", line, tag)
+	}
+
+	return j + 1 + end + len(tag), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || isLetter(c) || (c >= '0' && c <= '9')
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+const dollarIdents = "SELECT a$b$c FROM t;\nSELECT 1;\nSELECT x$b$ FROM u;"
+
+var dollarIdentStmts = []Statement{{"SELECT a$b$c FROM t", 1}, {"SELECT 1", 2}, {"SELECT x$b$ FROM u", 3}}
+
+func TestSplitStatements(t *testing.T) {
+	my, pg, lite := MySQLDialect{}, PostgresDialect{}, SqliteDialect{}
+
+	tests := []struct {
+		d      Dialect
+		script string
+		want   []Statement
+	}{
+		{my, "SELECT 1;\nSELECT 2;\n", []Statement{{"SELECT 1", 1}, {"SELECT 2", 2}}},
+		{my, "SELECT 1;  \r\nSELECT 2", []Statement{{"SELECT 1", 1}, {"SELECT 2", 2}}},
+		{my, "INSERT INTO t VALUES ('a;b', \"c;\", 'it''s', 'x\\';y');",
+			[]Statement{{"INSERT INTO t VALUES ('a;b', \"c;\", 'it''s', 'x\\';y')", 1}}},
+		{my, "SELECT `a;b` FROM t", []Statement{{"SELECT `a;b` FROM t", 1}}},
+		{my, "-- drop; it\n# also; this\n/* and;\nthis */\nSELECT 1; -- trailing;\n",
+			[]Statement{{"SELECT 1", 5}}},
+		{my, "SELECT 1--1;\nSELECT 2 --\n;", []Statement{{"SELECT 1--1", 1}, {"SELECT 2 --", 2}}},
+		{my, "/*!40101 SET NAMES utf8 */;\n", []Statement{{"/*!40101 SET NAMES utf8 */", 1}}},
+		{pg, "SELECT $1;\nCREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;",
+			[]Statement{{"SELECT $1", 1}, {"CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql", 2}}},
+		{my, "DELIMITER //\nCREATE PROCEDURE p()\nBEGIN\n  SELECT 1;\nEND//\ndelimiter ;\nCALL p();\n",
+			[]Statement{{"CREATE PROCEDURE p()\nBEGIN\n  SELECT 1;\nEND", 2}, {"CALL p()", 7}}},
+		{my, ";;\n  \n", nil},
+
+		// "#" is an operator and backslashes are literal outside E'...'
+		{pg, "SELECT a #> '{b}' FROM t; SELECT a #>> '{c}' FROM t;",
+			[]Statement{{"SELECT a #> '{b}' FROM t", 1}, {"SELECT a #>> '{c}' FROM t", 1}}},
+		{pg, "INSERT INTO t VALUES ('C:\\');\nSELECT E'x\\';y', e'z';",
+			[]Statement{{"INSERT INTO t VALUES ('C:\\')", 1}, {"SELECT E'x\\';y', e'z'", 2}}},
+		{pg, "SELECT 1 --x;\n;", []Statement{{"SELECT 1 --x;", 1}}},
+		{lite, "INSERT INTO t VALUES ('C:\\');\nSELECT 2;", []Statement{{"INSERT INTO t VALUES ('C:\\')", 1}, {"SELECT 2", 2}}},
+
+		// "$" inside an identifier does not start a dollar quoted body
+		{my, dollarIdents, dollarIdentStmts},
+		{pg, dollarIdents, dollarIdentStmts},
+		{lite, dollarIdents, dollarIdentStmts},
+		{&MySQLDialect{}, "# comment;\nSELECT `a;b`;", []Statement{{"SELECT `a;b`", 2}}},
+	}
+
+	for _, tt := range tests {
+		got, err := SplitStatements(tt.d, tt.script)
+
+		if err != nil {
+			t.Fatalf("%q: expected nil got %v", tt.script, err)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%T %q: expected %+v got %+v", tt.d, tt.script, tt.want, got)
+		}
+	}
+}
+
+func TestSplitStatementsError(t *testing.T) {
+	for _, script := range []string{"SELECT 1;\nSELECT 'a", "SELECT 1 /* x", "DELIMITER \n"} {
+		if _, err := SplitStatements(MySQLDialect{}, script); err == nil {
+			t.Errorf("%q: expected error", script)
+		}
+	}
+
+	// the backslash escapes the quote
+	if _, err := SplitStatements(MySQLDialect{}, "INSERT INTO t VALUES ('C:\\');"); err == nil {
+		t.Errorf("expected unterminated string error")
+	}
+}
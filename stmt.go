@@ -1,38 +1,413 @@
 package database
 
 import (
+	"container/list"
+	"context"
+	"database/sql"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 )
 
+// stmtCache keeps the most recently used prepared statements of a DB.
+//
+// Statements are prepared outside of the lock, once per query even when
+// several callers miss the cache at the same time. A statement evicted
+// while in use is closed when its last user releases it.
 type stmtCache struct {
-	cache map[string]*sqlx.Stmt
-	mu    sync.RWMutex
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // of *stmtEntry, most recently used first
+	entries map[string]*list.Element
+	stmts   map[*sqlx.Stmt]*stmtEntry
+	pending map[string]*stmtPrepare
+
+	hits, misses int64
+}
+
+type stmtEntry struct {
+	query   string
+	stmt    *sqlx.Stmt
+	refs    int
+	evicted bool
+}
+
+// stmtPrepare is a prepare in progress that other callers wait for.
+type stmtPrepare struct {
+	done chan struct{}
+	err  error
 }
 
 func newStmtCache() *stmtCache {
 	return &stmtCache{
-		cache: make(map[string]*sqlx.Stmt),
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		stmts:   make(map[*sqlx.Stmt]*stmtEntry),
+		pending: make(map[string]*stmtPrepare),
 	}
 }
 
-func (s *stmtCache) get(preparer Conn, q string) (*sqlx.Stmt, error) {
+func (s *stmtCache) enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size > 0
+}
+
+// setSize changes the number of cached statements, evicting the least
+// recently used ones. A size <= 0 disables the cache.
+func (s *stmtCache) setSize(n int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	stmt, ok := s.cache[q]
+	s.size = n
+	s.evict()
+}
 
-	if !ok {
-		var err error
-		stmt, err = preparer.Preparex(q)
+// evict removes entries beyond the size of the cache. s.mu is held.
+func (s *stmtCache) evict() {
+	for s.lru.Len() > 0 && s.lru.Len() > s.size {
+		s.remove(s.lru.Back())
+	}
+}
+
+// remove drops el from the cache and closes its statement unless it is
+// in use. s.mu is held.
+func (s *stmtCache) remove(el *list.Element) {
+	e := s.lru.Remove(el).(*stmtEntry)
+	delete(s.entries, e.query)
+	e.evicted = true
+
+	if e.refs == 0 {
+		delete(s.stmts, e.stmt)
+		e.stmt.Close()
+	}
+}
+
+// get returns the cached statement for q, preparing it on db if needed
+// and prepare is true, or nil otherwise. The statement must be handed
+// back with release.
+func (s *stmtCache) get(ctx context.Context, db *DB, q string, prepare bool) (*sqlx.Stmt, error) {
+	for {
+		s.mu.Lock()
+
+		if el, ok := s.entries[q]; ok {
+			s.lru.MoveToFront(el)
+			e := el.Value.(*stmtEntry)
+			e.refs++
+			s.hits++
+			s.mu.Unlock()
+			return e.stmt, nil
+		}
+
+		if !prepare {
+			s.misses++
+			s.mu.Unlock()
+			return nil, nil
+		}
+
+		if p, ok := s.pending[q]; ok {
+			s.mu.Unlock()
+
+			select {
+			case <-p.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+
+			if p.err != nil {
+				return nil, p.err
+			}
+			continue
+		}
+
+		p := &stmtPrepare{done: make(chan struct{})}
+		s.pending[q] = p
+		s.misses++
+		s.mu.Unlock()
+
+		stmt, err := db.DB.PreparexContext(ctx, q)
+
+		s.mu.Lock()
+		delete(s.pending, q)
+		p.err = err
+		close(p.done)
 
 		if err != nil {
+			s.mu.Unlock()
 			return nil, err
 		}
 
-		s.cache[q] = stmt
+		e := &stmtEntry{query: q, stmt: stmt, refs: 1}
+		s.stmts[stmt] = e
+
+		// a disabled cache still hands out the statement once
+		if s.size > 0 {
+			s.entries[q] = s.lru.PushFront(e)
+			s.evict()
+		} else {
+			e.evicted = true
+		}
+
+		s.mu.Unlock()
+		return stmt, nil
+	}
+}
+
+// release hands back a statement returned by get. It reports false if
+// stmt does not come from the cache.
+func (s *stmtCache) release(stmt *sqlx.Stmt) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.stmts[stmt]
+	if !ok {
+		return false
+	}
+
+	e.refs--
+	if e.evicted && e.refs == 0 {
+		delete(s.stmts, stmt)
+		stmt.Close()
+	}
+	return true
+}
+
+// invalidate drops the cached statement for q, so that the next get
+// prepares it again.
+func (s *stmtCache) invalidate(q string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[q]; ok {
+		s.remove(el)
+	}
+}
+
+func (s *stmtCache) stats() StmtCacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StmtCacheStats{Hits: s.hits, Misses: s.misses, Size: s.lru.Len()}
+}
+
+// close closes all cached statements and disables the cache.
+func (s *stmtCache) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.size = 0
+	s.evict()
+}
+
+// isReprepareError reports whether err asks for the statement to be
+// prepared again, which MySQL (1615) and Postgres do after the tables it
+// uses changed.
+func isReprepareError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "needs to be re-prepared") ||
+		strings.Contains(msg, "cached plan must not change result type")
+}
+
+// withStmt runs fn with the cached statement for q, rebound to tx if it
+// is not nil. The statement is prepared again once if it went stale.
+// withStmt reports false, without calling fn, if the cache is disabled
+// or q has no arguments; such statements are not worth preparing.
+//
+// Transactions only use statements that are already cached: preparing on
+// the DB needs a second connection, which may never become free while
+// the transaction holds its own.
+func (s *stmtCache) withStmt(ctx context.Context, db *DB, tx *sqlx.Tx, q string, nargs int, fn func(*sqlx.Stmt) error) (bool, error) {
+	if nargs == 0 || !s.enabled() {
+		return false, nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		stmt, err := s.get(ctx, db, q, tx == nil)
+		if err != nil {
+			return true, err
+		}
+		if stmt == nil {
+			return false, nil
+		}
+
+		use := stmt
+		if tx != nil {
+			use = tx.StmtxContext(ctx, stmt)
+		}
+
+		err = fn(use)
+
+		if tx != nil {
+			use.Close()
+		}
+		s.release(stmt)
+
+		if attempt == 0 && isReprepareError(err) {
+			s.invalidate(q)
+			continue
+		}
+		return true, err
+	}
+}
+
+// exec, query, queryx and queryRowx run q through the cache, rebound to
+// tx if it is not nil, or on direct if the statement is not cached.
+func (s *stmtCache) exec(ctx context.Context, db *DB, tx *sqlx.Tx, direct Conn, q string, args []interface{}) (res sql.Result, err error) {
+	ok, err := s.withStmt(ctx, db, tx, q, len(args), func(stmt *sqlx.Stmt) (err error) {
+		res, err = stmt.ExecContext(ctx, args...)
+		return err
+	})
+	if !ok {
+		return direct.ExecContext(ctx, q, args...)
+	}
+	return res, err
+}
+
+func (s *stmtCache) query(ctx context.Context, db *DB, tx *sqlx.Tx, direct Conn, q string, args []interface{}) (rows *sql.Rows, err error) {
+	ok, err := s.withStmt(ctx, db, tx, q, len(args), func(stmt *sqlx.Stmt) (err error) {
+		rows, err = stmt.QueryContext(ctx, args...)
+		return err
+	})
+	if !ok {
+		return direct.QueryContext(ctx, q, args...)
+	}
+	return rows, err
+}
+
+func (s *stmtCache) queryx(ctx context.Context, db *DB, tx *sqlx.Tx, direct Conn, q string, args []interface{}) (rows *sqlx.Rows, err error) {
+	ok, err := s.withStmt(ctx, db, tx, q, len(args), func(stmt *sqlx.Stmt) (err error) {
+		rows, err = stmt.QueryxContext(ctx, args...)
+		return err
+	})
+	if !ok {
+		return direct.QueryxContext(ctx, q, args...)
+	}
+	return rows, err
+}
+
+func (s *stmtCache) queryRowx(ctx context.Context, db *DB, tx *sqlx.Tx, direct Conn, q string, args []interface{}) (row *sqlx.Row) {
+	ok, _ := s.withStmt(ctx, db, tx, q, len(args), func(stmt *sqlx.Stmt) error {
+		row = stmt.QueryRowxContext(ctx, args...)
+		return row.Err()
+	})
+
+	// not cached, including after a stale statement of a transaction was
+	// dropped, or the statement could not be prepared and the error is
+	// reported by running it directly
+	if !ok || row == nil {
+		return direct.QueryRowxContext(ctx, q, args...)
+	}
+	return row
+}
+
+// SetStmtCacheSize enables caching of prepared statements for up to n
+// queries. With the cache enabled, statements with arguments run by the
+// DB and its transactions, including those of Exec, Queryx, QueryRowx
+// and the CRUD functions, are prepared once and reused. n <= 0 disables
+// the cache and closes the cached statements.
+func (db *DB) SetStmtCacheSize(n int) {
+	db.stmtCache.setSize(n)
+}
+
+// Close closes the cached statements and the database.
+func (db *DB) Close() error {
+	db.stmtCache.close()
+	mysqlAutoIncrSteps.Delete(db.DB.DB)
+	if db.tlsConfig != "" {
+		mysql.DeregisterTLSConfig(db.tlsConfig)
 	}
+	return db.DB.Close()
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := db.stmtCache.exec(ctx, db, nil, &db.DB, query, args)
+	db.observe(ctx, opExec, query, args, start, res, err)
+	return res, err
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := db.stmtCache.query(ctx, db, nil, &db.DB, query, args)
+	db.observe(ctx, opSelect, query, args, start, nil, err)
+	return rows, err
+}
+
+func (db *DB) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	return db.QueryxContext(context.Background(), query, args...)
+}
+
+func (db *DB) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	start := time.Now()
+	rows, err := db.stmtCache.queryx(ctx, db, nil, &db.DB, query, args)
+	db.observe(ctx, opSelect, query, args, start, nil, err)
+	return rows, err
+}
+
+func (db *DB) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return db.QueryRowxContext(context.Background(), query, args...)
+}
+
+func (db *DB) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	start := time.Now()
+	row := db.stmtCache.queryRowx(ctx, db, nil, &db.DB, query, args)
+	db.observe(ctx, opSelect, query, args, start, nil, row.Err())
+	return row
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := tx.db.stmtCache.exec(ctx, tx.db, tx.Tx, tx.Tx, query, args)
+	tx.db.observe(ctx, opExec, query, args, start, res, err)
+	return res, err
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := tx.db.stmtCache.query(ctx, tx.db, tx.Tx, tx.Tx, query, args)
+	tx.db.observe(ctx, opSelect, query, args, start, nil, err)
+	return rows, err
+}
+
+func (tx *Tx) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	return tx.QueryxContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	start := time.Now()
+	rows, err := tx.db.stmtCache.queryx(ctx, tx.db, tx.Tx, tx.Tx, query, args)
+	tx.db.observe(ctx, opSelect, query, args, start, nil, err)
+	return rows, err
+}
+
+func (tx *Tx) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return tx.QueryRowxContext(context.Background(), query, args...)
+}
 
-	return stmt, nil
+func (tx *Tx) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	start := time.Now()
+	row := tx.db.stmtCache.queryRowx(ctx, tx.db, tx.Tx, tx.Tx, query, args)
+	tx.db.observe(ctx, opSelect, query, args, start, nil, row.Err())
+	return row
 }
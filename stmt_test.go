@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func cachedQueries(db *DB) []string {
+	s := db.stmtCache
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var queries []string
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		queries = append(queries, el.Value.(*stmtEntry).query)
+	}
+	return queries
+}
+
+func TestStmtCache(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	db.SetStmtCacheSize(2)
+	defer db.SetStmtCacheSize(0)
+
+	f := &Friend{Name: "Foo"}
+
+	if err := Insert(db, f); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	f.Name = "Bar"
+
+	if n, err := Update(db, f); err != nil || n != 1 {
+		t.Fatalf("expected 1, nil got %d, %v", n, err)
+	}
+
+	var got Friend
+
+	if err := Get(db, &got, f.FriendID); err != nil || got.Name != "Bar" {
+		t.Fatalf("expected Bar, nil got %v, %v", got, err)
+	}
+
+	// the insert was evicted
+	if q := cachedQueries(db); len(q) != 2 || q[0] != DefaultDBMap.TableFor(f).getPlan.query {
+		t.Fatalf("unexpected cache %v", q)
+	}
+
+	// statements without arguments are not cached
+	if _, err := Scalar(db, "SELECT COUNT(*) FROM Friend"); err != nil {
+		t.Fatal(err)
+	}
+
+	if q := cachedQueries(db); len(q) != 2 {
+		t.Fatalf("unexpected cache %v", q)
+	}
+
+	// transactions rebind cached statements and do not prepare new ones
+	err := db.Transact(context.Background(), func(tx Conn) error {
+		var got Friend
+		if err := Get(tx, &got, f.FriendID); err != nil {
+			return err
+		}
+		return Insert(tx, &Friend{Name: "Baz"})
+	})
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if n, err := Delete(db, f); err != nil || n != 1 {
+		t.Fatalf("expected 1, nil got %d, %v", n, err)
+	}
+}
+
+func TestStmtCacheEvictInUse(t *testing.T) {
+	db := dbFromConf(t)
+	db.SetStmtCacheSize(1)
+	defer db.SetStmtCacheSize(0)
+
+	ctx := context.Background()
+	q := "SELECT ? + 1"
+
+	var wg sync.WaitGroup
+	stmts := make([]interface{}, 8)
+
+	for i := range stmts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stmt, err := Prepare(db, q)
+			if err != nil {
+				t.Error(err)
+			}
+			stmts[i] = stmt
+		}(i)
+	}
+	wg.Wait()
+
+	// concurrent misses prepare the query once
+	for _, stmt := range stmts[1:] {
+		if stmt != stmts[0] {
+			t.Fatalf("expected one statement for concurrent prepares")
+		}
+	}
+
+	stmt, err := db.stmtCache.get(ctx, db, q, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// evicted while in use, closed on the last release
+	db.SetStmtCacheSize(0)
+
+	var n int64
+	if err := stmt.QueryRowx(1).Scan(&n); err != nil || n != 2 {
+		t.Fatalf("expected 2, nil got %d, %v", n, err)
+	}
+
+	for range stmts {
+		StmtClose(db, stmt)
+	}
+	StmtClose(db, stmt)
+
+	if err := stmt.QueryRowx(1).Scan(&n); err == nil {
+		t.Fatalf("expected closed statement")
+	}
+}
+
+func TestIsReprepareError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("Error 1615: Prepared statement needs to be re-prepared"), true},
+		{errors.New("pq: cached plan must not change result type"), true},
+		{errors.New("Error 1062: Duplicate entry"), false},
+	} {
+		if got := isReprepareError(tt.err); got != tt.want {
+			t.Errorf("%v: expected %v got %v", tt.err, tt.want, got)
+		}
+	}
+}
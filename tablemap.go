@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -16,6 +17,20 @@ func (n NoKeysErr) Error() string {
 	return fmt.Sprintf("Could not find keys for table %v", n.Table)
 }
 
+// OptimisticLockError is returned by Update when a table has a version
+// column and no row matched both the keys and the version of the struct,
+// meaning the row was changed or deleted since it was loaded.
+type OptimisticLockError struct {
+	TableName    string
+	Keys         []interface{}
+	LocalVersion int64
+}
+
+func (e OptimisticLockError) Error() string {
+	return fmt.Sprintf("Optimistic lock failed for table %s keys %v version %d",
+		e.TableName, e.Keys, e.LocalVersion)
+}
+
 // TableMap represents a mapping between a Go struct and a database table
 // Use dbmap.AddTable() or dbmap.AddTableWithName() to create these
 type TableMap struct {
@@ -25,21 +40,37 @@ type TableMap struct {
 	columns    []*ColumnMap
 	columnsStr string
 	keys       []*ColumnMap
+	version    *ColumnMap
 	insertPlan bindPlan
 	updatePlan bindPlan
 	deletePlan bindPlan
 	getPlan    bindPlan
 	dbmap      *DbMap
+
+	// mu guards columnsStr and the plans, which are built on first use
+	mu                 sync.Mutex
+	updateColumnsPlans map[string]bindPlan
+
+	// index path of the Snapshot field if the table tracks changes
+	snapshotIndex []int
 }
 
 // ResetSql removes cached insert/update/select/delete SQL strings
 // associated with this TableMap.  Call this if you've modified
 // any column names or the table name itself.
 func (t *TableMap) ResetSql() {
+	t.mu.Lock()
+	t.columnsStr = ""
 	t.insertPlan = bindPlan{}
 	t.updatePlan = bindPlan{}
 	t.deletePlan = bindPlan{}
 	t.getPlan = bindPlan{}
+	t.updateColumnsPlans = nil
+	t.mu.Unlock()
+
+	if t.dbmap != nil {
+		t.dbmap.resetDialectMaps()
+	}
 }
 
 // SetKeys lets you specify the fields on a struct that map to primary
@@ -48,6 +79,10 @@ func (t *TableMap) ResetSql() {
 //
 // Automatically calls ResetSql() to ensure SQL statements are regenerated.
 func (t *TableMap) SetKeys(isAutoIncr bool, fieldNames ...string) *TableMap {
+	for _, col := range t.keys {
+		col.isPK = false
+		col.isAutoIncr = false
+	}
 	t.keys = make([]*ColumnMap, 0)
 	for _, name := range fieldNames {
 		colmap := t.ColMap(sqlx.NameMapper(name))
@@ -60,6 +95,26 @@ func (t *TableMap) SetKeys(isAutoIncr bool, fieldNames ...string) *TableMap {
 	return t
 }
 
+// SetVersionCol sets the column used for optimistic locking. Insert
+// initialises the version to 1 and Update increments it, matching rows on
+// the keys and the previous version. The field must be a signed integer.
+//
+// Automatically calls ResetSql() to ensure SQL statements are regenerated.
+func (t *TableMap) SetVersionCol(field string) *TableMap {
+	c := t.ColMap(field)
+
+	switch c.gotype.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+	default:
+		panic(fmt.Sprintf("Version column %s in table %s must be a signed integer, got %s",
+			field, t.TableName, c.gotype))
+	}
+
+	t.version = c
+	t.ResetSql()
+	return t
+}
+
 // ColMap returns the ColumnMap pointer matching the given struct field
 // name.  It panics if the struct does not contain a field matching this
 // name.
@@ -85,12 +140,16 @@ func colMapOrNil(t *TableMap, field string) *ColumnMap {
 }
 
 func (t *TableMap) ColumnsStr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	t.setColumnsStr()
 	return t.columnsStr
 }
 
 func (t *TableMap) setColumnsStr() {
 	if t.columnsStr == "" {
+		d := t.dbmap.dialect()
 		s := bytes.Buffer{}
 		x := 0
 		for _, col := range t.columns {
@@ -98,9 +157,9 @@ func (t *TableMap) setColumnsStr() {
 				if x > 0 {
 					s.WriteString(",")
 				}
-				s.WriteString(QuoteField(t.TableName))
+				s.WriteString(d.QuoteField(t.TableName))
 				s.WriteString(".")
-				s.WriteString(QuoteField(col.ColumnName))
+				s.WriteString(d.QuoteField(col.ColumnName))
 				x++
 			}
 		}
@@ -108,9 +167,74 @@ func (t *TableMap) setColumnsStr() {
 	}
 }
 
+// createTableSql returns the CREATE TABLE statement for the table. A
+// single primary key is declared on its column so that auto-increment
+// constraints can follow it; composite keys become a table constraint.
+func (t *TableMap) createTableSql(ifNotExists bool) string {
+	d := t.dbmap.dialect()
+
+	s := bytes.Buffer{}
+	s.WriteString("CREATE TABLE ")
+	if ifNotExists {
+		s.WriteString("IF NOT EXISTS ")
+	}
+	s.WriteString(d.QuoteField(t.TableName))
+	s.WriteString(" (")
+
+	x := 0
+	for _, col := range t.columns {
+		if col.Transient {
+			continue
+		}
+		if x > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(d.QuoteField(col.ColumnName))
+		s.WriteString(" ")
+		s.WriteString(d.ToSqlType(col))
+
+		if col.isPK {
+			s.WriteString(" NOT NULL")
+			if len(t.keys) == 1 {
+				s.WriteString(" PRIMARY KEY")
+			}
+		}
+		if col.Unique {
+			s.WriteString(" UNIQUE")
+		}
+		if col.isAutoIncr {
+			if ai := d.AutoIncrStr(); ai != "" {
+				s.WriteString(" ")
+				s.WriteString(ai)
+			}
+		}
+		x++
+	}
+
+	if len(t.keys) > 1 {
+		s.WriteString(", PRIMARY KEY (")
+		for x := range t.keys {
+			if x > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(d.QuoteField(t.keys[x].ColumnName))
+		}
+		s.WriteString(")")
+	}
+
+	s.WriteString(")")
+	s.WriteString(d.CreateTableSuffix())
+	s.WriteString(";")
+	return s.String()
+}
+
 func (t *TableMap) bindGet() bindPlan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	plan := t.getPlan
 	if plan.query == "" {
+		d := t.dbmap.dialect()
 
 		s := bytes.Buffer{}
 		s.WriteString("select ")
@@ -121,24 +245,24 @@ func (t *TableMap) bindGet() bindPlan {
 				if x > 0 {
 					s.WriteString(",")
 				}
-				s.WriteString(QuoteField(col.ColumnName))
-				plan.argFields = append(plan.argFields, col.fieldName)
+				s.WriteString(d.QuoteField(col.ColumnName))
+				plan.argFields = append(plan.argFields, col)
 				x++
 			}
 		}
 		s.WriteString(" FROM ")
-		s.WriteString(QuoteField(t.TableName))
+		s.WriteString(d.QuoteField(t.TableName))
 		s.WriteString(" WHERE ")
 		for x := range t.keys {
 			col := t.keys[x]
 			if x > 0 {
 				s.WriteString(" AND ")
 			}
-			s.WriteString(QuoteField(col.ColumnName))
+			s.WriteString(d.QuoteField(col.ColumnName))
 			s.WriteString("=")
-			s.WriteString("?")
+			s.WriteString(d.BindVar(x))
 
-			plan.keyFields = append(plan.keyFields, col.fieldName)
+			plan.keyFields = append(plan.keyFields, col)
 		}
 		s.WriteString(";")
 
@@ -150,11 +274,19 @@ func (t *TableMap) bindGet() bindPlan {
 }
 
 func (t *TableMap) bindDelete(elem reflect.Value) bindInstance {
+	return t.deleteBindPlan().createBindInstance(elem)
+}
+
+func (t *TableMap) deleteBindPlan() bindPlan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	plan := t.deletePlan
 	if plan.query == "" {
+		d := t.dbmap.dialect()
 
 		s := bytes.Buffer{}
-		s.WriteString(fmt.Sprintf("DELETE FROM %s", QuoteField(t.TableName)))
+		s.WriteString(fmt.Sprintf("DELETE FROM %s", d.QuoteField(t.TableName)))
 		s.WriteString(" WHERE ")
 
 		for x := range t.keys {
@@ -162,12 +294,12 @@ func (t *TableMap) bindDelete(elem reflect.Value) bindInstance {
 			if x > 0 {
 				s.WriteString(" AND ")
 			}
-			s.WriteString(QuoteField(k.ColumnName))
+			s.WriteString(d.QuoteField(k.ColumnName))
 			s.WriteString("=")
-			s.WriteString("?")
+			s.WriteString(d.BindVar(x))
 
-			plan.keyFields = append(plan.keyFields, k.fieldName)
-			plan.argFields = append(plan.argFields, k.fieldName)
+			plan.keyFields = append(plan.keyFields, k)
+			plan.argFields = append(plan.argFields, k)
 		}
 		s.WriteString(";")
 
@@ -175,82 +307,151 @@ func (t *TableMap) bindDelete(elem reflect.Value) bindInstance {
 		t.deletePlan = plan
 	}
 
-	return plan.createBindInstance(elem)
+	return plan
 }
 
 func (t *TableMap) bindUpdate(elem reflect.Value) bindInstance {
+	t.mu.Lock()
 	plan := t.updatePlan
 	if plan.query == "" {
+		plan = t.newUpdatePlan(func(*ColumnMap) bool { return true })
+		t.updatePlan = plan
+	}
+	t.mu.Unlock()
 
-		s := bytes.Buffer{}
-		s.WriteString(fmt.Sprintf("UPDATE %s SET ", QuoteField(t.TableName)))
-		x := 0
+	return plan.createBindInstance(elem)
+}
 
-		for y := range t.columns {
-			col := t.columns[y]
-			if !col.isPK && !col.Transient {
-				if x > 0 {
-					s.WriteString(", ")
-				}
-				s.WriteString(QuoteField(col.ColumnName))
-				s.WriteString("=")
-				s.WriteString("?")
+// bindUpdateColumns binds an UPDATE of the given columns, which must be
+// neither keys nor transient. The plan is cached per column set. A
+// version column is always updated.
+func (t *TableMap) bindUpdateColumns(elem reflect.Value, cols []*ColumnMap) bindInstance {
+	set := make(map[*ColumnMap]bool, len(cols))
+	for _, col := range cols {
+		set[col] = true
+	}
 
-				plan.argFields = append(plan.argFields, col.fieldName)
-				x++
-			}
+	key := bytes.Buffer{}
+	for _, col := range t.columns {
+		if set[col] {
+			key.WriteString(col.ColumnName)
+			key.WriteString(",")
 		}
+	}
 
-		s.WriteString(" WHERE ")
-		for y := range t.keys {
-			col := t.keys[y]
-			if y > 0 {
-				s.WriteString(" AND ")
+	t.mu.Lock()
+	plan, ok := t.updateColumnsPlans[key.String()]
+	if !ok {
+		plan = t.newUpdatePlan(func(col *ColumnMap) bool { return set[col] })
+		if t.updateColumnsPlans == nil {
+			t.updateColumnsPlans = make(map[string]bindPlan)
+		}
+		t.updateColumnsPlans[key.String()] = plan
+	}
+	t.mu.Unlock()
+
+	return plan.createBindInstance(elem)
+}
+
+// newUpdatePlan returns an UPDATE plan setting the non-key columns
+// selected by include and the version column.
+func (t *TableMap) newUpdatePlan(include func(*ColumnMap) bool) bindPlan {
+	plan := bindPlan{}
+	d := t.dbmap.dialect()
+
+	s := bytes.Buffer{}
+	s.WriteString(fmt.Sprintf("UPDATE %s SET ", d.QuoteField(t.TableName)))
+	x := 0
+
+	for y := range t.columns {
+		col := t.columns[y]
+		if !col.isPK && !col.Transient && !col.ReadOnly && (include(col) || col == t.version) {
+			if x > 0 {
+				s.WriteString(", ")
 			}
-			s.WriteString(QuoteField(col.ColumnName))
+			s.WriteString(d.QuoteField(col.ColumnName))
 			s.WriteString("=")
-			s.WriteString("?")
+			s.WriteString(d.BindVar(x))
 
-			plan.argFields = append(plan.argFields, col.fieldName)
-			plan.keyFields = append(plan.keyFields, col.fieldName)
+			if col == t.version {
+				plan.argFields = append(plan.argFields, nil)
+			} else {
+				plan.argFields = append(plan.argFields, col)
+			}
 			x++
 		}
-		s.WriteString(";")
+	}
 
-		plan.query = s.String()
-		t.updatePlan = plan
+	s.WriteString(" WHERE ")
+	for y := range t.keys {
+		col := t.keys[y]
+		if y > 0 {
+			s.WriteString(" AND ")
+		}
+		s.WriteString(d.QuoteField(col.ColumnName))
+		s.WriteString("=")
+		s.WriteString(d.BindVar(x))
+
+		plan.argFields = append(plan.argFields, col)
+		plan.keyFields = append(plan.keyFields, col)
+		x++
 	}
 
-	return plan.createBindInstance(elem)
+	if t.version != nil {
+		s.WriteString(" AND ")
+		s.WriteString(d.QuoteField(t.version.ColumnName))
+		s.WriteString("=")
+		s.WriteString(d.BindVar(x))
+
+		plan.argFields = append(plan.argFields, t.version)
+		plan.versCol = t.version
+	}
+	s.WriteString(";")
+
+	plan.query = s.String()
+
+	return plan
 }
 
 func (t *TableMap) bindInsert(elem reflect.Value) bindInstance {
+	return t.insertBindPlan().createBindInstance(elem)
+}
+
+// insertBindPlan returns the INSERT plan of the table, which is also the
+// base of batch inserts and upserts.
+func (t *TableMap) insertBindPlan() bindPlan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	plan := t.insertPlan
 	if plan.query == "" {
 		plan.autoIncrIdx = -1
+		d := t.dbmap.dialect()
 
 		s := bytes.Buffer{}
 		s2 := bytes.Buffer{}
-		s.WriteString(fmt.Sprintf("INSERT INTO %s (", QuoteField(t.TableName)))
+		s.WriteString(fmt.Sprintf("INSERT INTO %s (", d.QuoteField(t.TableName)))
 
 		x := 0
 		first := true
 		for y := range t.columns {
 			col := t.columns[y]
 
-			if !col.Transient {
+			if !col.Transient && !col.ReadOnly {
 				if !first {
 					s.WriteString(",")
 					s2.WriteString(",")
 				}
-				s.WriteString(QuoteField(col.ColumnName))
+				s.WriteString(d.QuoteField(col.ColumnName))
 
 				if col.isAutoIncr {
-					s2.WriteString("NULL")
+					s2.WriteString(d.AutoIncrBindValue())
 					plan.autoIncrIdx = y
+					plan.valueLits = append(plan.valueLits, d.AutoIncrBindValue())
 				} else {
-					s2.WriteString("?")
-					plan.argFields = append(plan.argFields, col.fieldName)
+					s2.WriteString(d.BindVar(x))
+					plan.argFields = append(plan.argFields, col)
+					plan.valueLits = append(plan.valueLits, "")
 
 					x++
 				}
@@ -258,11 +459,14 @@ func (t *TableMap) bindInsert(elem reflect.Value) bindInstance {
 				first = false
 			}
 		}
-		s.WriteString(") VALUES (")
+		s.WriteString(") VALUES ")
+		plan.insertHead = s.String()
+		s.WriteString("(")
 		s.WriteString(s2.String())
 		s.WriteString(")")
 		if plan.autoIncrIdx > -1 {
-			s.WriteString("")
+			plan.insertSuffix = d.AutoIncrInsertSuffix(t.columns[plan.autoIncrIdx])
+			s.WriteString(plan.insertSuffix)
 		}
 		s.WriteString(";")
 
@@ -270,7 +474,54 @@ func (t *TableMap) bindInsert(elem reflect.Value) bindInstance {
 		t.insertPlan = plan
 	}
 
-	return plan.createBindInstance(elem)
+	return plan
+}
+
+// bindInsertBatch returns a multi-row INSERT statement for elems built
+// from the insert plan.
+func (t *TableMap) bindInsertBatch(elems []reflect.Value) bindInstance {
+	plan := t.insertBindPlan()
+	bi := plan.createBindInstance(elems[0])
+	d := t.dbmap.dialect()
+
+	s := bytes.Buffer{}
+	s.WriteString(plan.insertHead)
+
+	x := 0
+	for i, elem := range elems {
+		if i > 0 {
+			s.WriteString(",")
+			bi.args = append(bi.args, plan.createBindInstance(elem).args...)
+		}
+
+		x = plan.writeValues(&s, d, x)
+	}
+
+	s.WriteString(plan.insertSuffix)
+	s.WriteString(";")
+
+	bi.query = s.String()
+	return bi
+}
+
+// writeValues writes the parenthesised values of one row of an insert
+// plan, numbering its bind variables from x, and returns the next bind
+// variable index.
+func (plan bindPlan) writeValues(s *bytes.Buffer, d Dialect, x int) int {
+	s.WriteString("(")
+	for y, lit := range plan.valueLits {
+		if y > 0 {
+			s.WriteString(",")
+		}
+		if lit != "" {
+			s.WriteString(lit)
+		} else {
+			s.WriteString(d.BindVar(x))
+			x++
+		}
+	}
+	s.WriteString(")")
+	return x
 }
 
 // ColumnMap represents a mapping between a Go struct field and a single
@@ -291,7 +542,12 @@ type ColumnMap struct {
 	// correct column type to map to in CreateTables()
 	MaxSize int
 
+	// If true, the column is read by Get and Select but never written by
+	// Insert or Update, leaving its value to the database.
+	ReadOnly bool
+
 	fieldName  string
+	fieldIndex []int
 	gotype     reflect.Type
 	sqltype    string
 	isPK       bool
@@ -305,34 +561,115 @@ func (c *ColumnMap) SetTransient(b bool) *ColumnMap {
 	return c
 }
 
+// SetUnique adds "unique" to the create table statements for this
+// column, if b is true.
+func (c *ColumnMap) SetUnique(b bool) *ColumnMap {
+	c.Unique = b
+	return c
+}
+
+// SetMaxSize specifies the max length of values in this column. This is
+// passed to the dialect.ToSqlType() function, which can use the value
+// to alter the generated type for "create table" statements
+func (c *ColumnMap) SetMaxSize(size int) *ColumnMap {
+	c.MaxSize = size
+	return c
+}
+
+// SetReadOnly excludes the column from INSERT and UPDATE statements if b
+// is true.
+func (c *ColumnMap) SetReadOnly(b bool) *ColumnMap {
+	c.ReadOnly = b
+	return c
+}
+
+// SetSqlType overrides the column type derived by the dialect in
+// "create table" statements.
+func (c *ColumnMap) SetSqlType(t string) *ColumnMap {
+	c.sqltype = t
+	return c
+}
+
+// value returns the column's field in elem. The fields of a nil
+// embedded pointer read as their zero value.
+func (c *ColumnMap) value(elem reflect.Value) reflect.Value {
+	v := elem
+	for _, i := range c.fieldIndex {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Zero(c.gotype)
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v
+}
+
+// field returns the settable field of the column in elem, allocating
+// nil embedded pointers on the way.
+func (c *ColumnMap) field(elem reflect.Value) reflect.Value {
+	return fieldByIndex(elem, c.fieldIndex)
+}
+
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for _, i := range index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v
+}
+
 type bindPlan struct {
-	query       string
-	argFields   []string
-	keyFields   []string
+	query string
+
+	// Columns bound by the statement, in order. A nil entry of an update
+	// plan binds the incremented value of the version column.
+	argFields   []*ColumnMap
+	keyFields   []*ColumnMap
+	versCol     *ColumnMap
 	autoIncrIdx int
+
+	// Insert plans keep the statement up to VALUES, the literal of each
+	// value ("" for a bind variable) and the trailing clause so that
+	// multi-row statements can be built from them.
+	insertHead   string
+	valueLits    []string
+	insertSuffix string
 }
 
 func (plan bindPlan) createBindInstance(elem reflect.Value) bindInstance {
-	bi := bindInstance{query: plan.query, autoIncrIdx: plan.autoIncrIdx}
+	bi := bindInstance{query: plan.query, autoIncrIdx: plan.autoIncrIdx, versCol: plan.versCol}
 
-	for i := 0; i < len(plan.argFields); i++ {
-		k := plan.argFields[i]
-		val := elem.FieldByName(k).Interface()
-		bi.args = append(bi.args, val)
+	if plan.versCol != nil {
+		bi.existingVersion = plan.versCol.value(elem).Int()
 	}
 
-	for i := 0; i < len(plan.keyFields); i++ {
-		k := plan.keyFields[i]
-		val := elem.FieldByName(k).Interface()
-		bi.keys = append(bi.keys, val)
+	for _, col := range plan.argFields {
+		if col == nil {
+			bi.args = append(bi.args, bi.existingVersion+1)
+			continue
+		}
+		bi.args = append(bi.args, col.value(elem).Interface())
+	}
+
+	for _, col := range plan.keyFields {
+		bi.keys = append(bi.keys, col.value(elem).Interface())
 	}
 
 	return bi
 }
 
 type bindInstance struct {
-	query       string
-	args        []interface{}
-	keys        []interface{}
-	autoIncrIdx int
+	query           string
+	args            []interface{}
+	keys            []interface{}
+	versCol         *ColumnMap
+	existingVersion int64
+	autoIncrIdx     int
 }
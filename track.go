@@ -0,0 +1,154 @@
+package database
+
+import (
+	"reflect"
+)
+
+// Snapshot enables change tracking for a mapped struct. Add a Snapshot
+// field to the struct; it is not mapped to a column. Rows loaded with
+// Get or Select, and rows written with Insert or Update, record their
+// column values in the snapshot. A later Update of the struct only
+// writes the columns whose values changed since, and does not touch the
+// database at all when nothing changed.
+//
+// A copy of a struct starts with the snapshot of the original, and writes
+// of either do not change the snapshot of the other. The copy only tracks
+// the row correctly until the original is written; Reset it when both are
+// updated.
+type Snapshot struct {
+	values []interface{}
+}
+
+// Loaded reports whether the snapshot holds the values of a row.
+func (s *Snapshot) Loaded() bool {
+	return s.values != nil
+}
+
+// Reset discards the snapshot so that the next Update writes all
+// columns.
+func (s *Snapshot) Reset() {
+	s.values = nil
+}
+
+var snapshotType = reflect.TypeOf(Snapshot{})
+
+// snapshot returns the Snapshot of elem, or nil if the table does not
+// track changes.
+func (t *TableMap) snapshot(elem reflect.Value) *Snapshot {
+	if t.snapshotIndex == nil {
+		return nil
+	}
+	return fieldByIndex(elem, t.snapshotIndex).Addr().Interface().(*Snapshot)
+}
+
+// takeSnapshot records the current column values of elem.
+func (t *TableMap) takeSnapshot(elem reflect.Value) {
+	s := t.snapshot(elem)
+	if s == nil {
+		return
+	}
+
+	s.values = make([]interface{}, len(t.columns))
+	for i, col := range t.columns {
+		if !col.Transient {
+			s.values[i] = snapshotValue(col.value(elem))
+		}
+	}
+}
+
+// updateSnapshot records the values of cols, or of all columns if cols
+// is nil, after they were written. A partial write leaves a missing
+// snapshot missing.
+func (t *TableMap) updateSnapshot(elem reflect.Value, cols []*ColumnMap) {
+	s := t.snapshot(elem)
+	if s == nil {
+		return
+	}
+
+	if cols == nil {
+		t.takeSnapshot(elem)
+		return
+	}
+
+	if s.values == nil {
+		return
+	}
+
+	// copies of the struct share the values
+	values := append([]interface{}(nil), s.values...)
+	for i, col := range t.columns {
+		if col == t.version || containsColumn(cols, col) {
+			values[i] = snapshotValue(col.value(elem))
+		}
+	}
+	s.values = values
+}
+
+// changedColumns returns the non-key columns of elem whose values differ
+// from its snapshot, or nil if elem has no loaded snapshot.
+func (t *TableMap) changedColumns(elem reflect.Value) []*ColumnMap {
+	s := t.snapshot(elem)
+	if s == nil || s.values == nil {
+		return nil
+	}
+
+	cols := make([]*ColumnMap, 0, len(t.columns))
+	for i, col := range t.columns {
+		if col.isPK || col.Transient || col.ReadOnly || col == t.version {
+			continue
+		}
+		if !reflect.DeepEqual(s.values[i], snapshotValue(col.value(elem))) {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// snapshotValue copies the value of f so that later changes to pointed
+// to values or byte slices are detected.
+func snapshotValue(f reflect.Value) interface{} {
+	switch {
+	case f.Kind() == reflect.Ptr:
+		if f.IsNil() {
+			return nil
+		}
+		return snapshotValue(f.Elem())
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8:
+		if f.IsNil() {
+			return []byte(nil)
+		}
+		return append([]byte{}, f.Bytes()...)
+	}
+	return f.Interface()
+}
+
+// takeSnapshots records the snapshots of dest, a pointer to a struct or
+// to a slice of structs or struct pointers, if its table tracks changes.
+func takeSnapshots(m *DbMap, dest interface{}) {
+	v := reflect.Indirect(reflect.ValueOf(dest))
+
+	if v.Kind() == reflect.Struct {
+		if t := m.TableForType(v.Type()); t != nil {
+			t.takeSnapshot(v)
+		}
+		return
+	}
+
+	if v.Kind() != reflect.Slice {
+		return
+	}
+
+	et := v.Type().Elem()
+	if et.Kind() == reflect.Ptr {
+		et = et.Elem()
+	}
+
+	t := m.TableForType(et)
+	if t == nil || t.snapshotIndex == nil {
+		return
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		t.takeSnapshot(reflect.Indirect(v.Index(i)))
+	}
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+type Profile struct {
+	ProfileID int
+	Name      string
+	Bio       string
+	Avatar    []byte
+	Snapshot
+}
+
+func init() {
+	DefaultDBMap.AddTableWithName(Profile{}, "Profile").SetKeys(true, "ProfileID")
+}
+
+func TestSnapshot(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	p := &Profile{Name: "Foo", Bio: "bio", Avatar: []byte{1}}
+
+	if err := Insert(db, p); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if !p.Loaded() {
+		t.Fatalf("expected snapshot after insert")
+	}
+
+	// nothing changed, no statement is run
+	if n, err := Update(db, p); err != nil || n != 0 {
+		t.Fatalf("expected 0, nil got %d, %v", n, err)
+	}
+
+	var loaded Profile
+
+	if err := Get(db, &loaded, p.ProfileID); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if cols := DefaultDBMap.TableFor(&loaded).changedColumns(reflectElem(&loaded)); len(cols) != 0 {
+		t.Fatalf("expected no changes got %d", len(cols))
+	}
+
+	// a concurrent write of another column is not overwritten
+	if _, err := Exec(db, "UPDATE Profile SET Bio = 'other' WHERE ProfileID = ?", p.ProfileID); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded.Name = "Bar"
+	loaded.Avatar[0] = 2
+
+	cols := DefaultDBMap.TableFor(&loaded).changedColumns(reflectElem(&loaded))
+
+	if len(cols) != 2 || cols[0].ColumnName != "Name" || cols[1].ColumnName != "Avatar" {
+		t.Fatalf("expected Name, Avatar changed got %v", cols)
+	}
+
+	if n, err := Update(db, &loaded); err != nil || n != 1 {
+		t.Fatalf("expected 1, nil got %d, %v", n, err)
+	}
+
+	var profiles []Profile
+
+	if err := Select(db, &profiles, "SELECT * FROM Profile"); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if got := profiles[0]; got.Name != "Bar" || got.Bio != "other" || got.Avatar[0] != 2 || !got.Loaded() {
+		t.Fatalf("unexpected %+v", got)
+	}
+}
+
+func TestSnapshotCopy(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	a := &Profile{Name: "Foo", Bio: "bio"}
+
+	if err := Insert(db, a); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	b := *a
+	b.Name = "Bar"
+
+	if n, err := Update(db, &b); err != nil || n != 1 {
+		t.Fatalf("expected 1, nil got %d, %v", n, err)
+	}
+
+	// the update of the copy leaves the snapshot of a as it was
+	if cols := DefaultDBMap.TableFor(a).changedColumns(reflectElem(a)); len(cols) != 0 {
+		t.Fatalf("expected no changes got %v", cols)
+	}
+}
+
+func reflectElem(ptr interface{}) reflect.Value {
+	return reflect.ValueOf(ptr).Elem()
+}
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Tx is a transaction started by Transact or Beginx. Its statements go
+// through the statement cache and Observer of its DB. Nested calls to
+// Transact with a *Tx run inside a savepoint of the outer transaction.
+type Tx struct {
+	*sqlx.Tx
+	db         *DB
+	savepoints int
+}
+
+// Transact runs fn inside a transaction on conn. The transaction is
+// committed when fn returns nil and rolled back when fn returns an error
+// or panics.
+//
+// If conn is a *Tx, fn runs inside a savepoint and an error only rolls
+// back to the savepoint. If conn is a *DB, fn is re-run up to
+// MaxTxRetries times when the transaction fails with a deadlock or a lock
+// wait timeout, so fn should not have side effects outside of tx. The
+// retries wait a random delay so that the conflicting transactions do not
+// collide again.
+func Transact(ctx context.Context, conn Conn, fn func(tx Conn) error) error {
+	switch c := conn.(type) {
+	case *DB:
+		return c.Transact(ctx, fn)
+	case *Tx:
+		return c.Transact(ctx, fn)
+	default:
+		return fmt.Errorf("Transact needs a *DB or *Tx, but got: %T", conn)
+	}
+}
+
+// Transact runs fn inside a new transaction. See the package level
+// Transact.
+func (db *DB) Transact(ctx context.Context, fn func(tx Conn) error) error {
+	for attempt := 0; ; attempt++ {
+		err := db.transact(ctx, fn)
+
+		if err == nil || attempt >= db.MaxTxRetries || !isRetryableTxError(db.Dialect, err) {
+			return err
+		}
+
+		t := time.NewTimer(txRetryDelay(attempt))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+// txRetryDelay returns a random delay before the retry after attempt, up
+// to 10ms doubling with every attempt to at most 1s.
+func txRetryDelay(attempt int) time.Duration {
+	max := time.Second
+	if attempt < 7 {
+		max = 10 * time.Millisecond << uint(attempt)
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// Beginx starts a transaction. It shadows the method of sqlx.DB so that
+// the statements of the transaction are observed like those of db; the
+// Begin and BeginTx methods of sql.DB return a *sql.Tx that bypasses the
+// statement cache, the Observer and the wrapping of errors.
+func (db *DB) Beginx() (*Tx, error) {
+	return db.BeginTxx(context.Background(), nil)
+}
+
+// BeginTxx starts a transaction with opts, see Beginx.
+func (db *DB) BeginTxx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	sqlxTx, err := db.DB.BeginTxx(ctx, opts)
+
+	if err != nil {
+		return nil, wrapError(ctx, db.Dialect, opExec, "", "", err)
+	}
+
+	return &Tx{Tx: sqlxTx, db: db}, nil
+}
+
+// MustBegin starts a transaction and panics on error, see Beginx.
+func (db *DB) MustBegin() *Tx {
+	return db.MustBeginTx(context.Background(), nil)
+}
+
+// MustBeginTx starts a transaction with opts and panics on error, see
+// Beginx.
+func (db *DB) MustBeginTx(ctx context.Context, opts *sql.TxOptions) *Tx {
+	tx, err := db.BeginTxx(ctx, opts)
+	if err != nil {
+		panic(err)
+	}
+	return tx
+}
+
+func (db *DB) transact(ctx context.Context, fn func(tx Conn) error) (err error) {
+	tx, err := db.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Transact runs fn inside a savepoint of tx. The savepoint is released
+// when fn returns nil and rolled back when fn returns an error or
+// panics; the outer transaction stays open in both cases. The rollback
+// runs even if ctx is done. If it fails, as when the engine dropped the
+// savepoint on a deadlock, the returned error wraps both the error of fn
+// and that of the rollback, so that DB.Transact still retries a
+// deadlock.
+func (tx *Tx) Transact(ctx context.Context, fn func(tx Conn) error) (err error) {
+	tx.savepoints++
+	name := fmt.Sprintf("sp%d", tx.savepoints)
+
+	if _, err = tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.ExecContext(context.Background(), "ROLLBACK TO SAVEPOINT "+name)
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		if _, rbErr := tx.ExecContext(context.Background(), "ROLLBACK TO SAVEPOINT "+name); rbErr != nil {
+			return fmt.Errorf("%w: rollback to savepoint %s: %w", err, name, rbErr)
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
+
+// isRetryableTxError reports whether err is a deadlock or lock wait
+// timeout in the dialect d, after which the transaction can be re-run.
+func isRetryableTxError(d Dialect, err error) bool {
+	kind, _ := classifyError(d, err)
+	return kind == ErrDeadlock || kind == ErrLockWaitTimeout
+}
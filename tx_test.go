@@ -0,0 +1,198 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestTransact(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+
+	err := db.Transact(ctx, func(tx Conn) error {
+		if err := Insert(tx, &Friend{Name: "Foo"}); err != nil {
+			return err
+		}
+
+		// the inner error only rolls back the savepoint
+		err := Transact(ctx, tx, func(tx Conn) error {
+			if err := Insert(tx, &Friend{Name: "Bar"}); err != nil {
+				return err
+			}
+			return errAbort
+		})
+
+		if err != errAbort {
+			t.Fatalf("expected %v got %v", errAbort, err)
+		}
+
+		return Transact(ctx, tx, func(tx Conn) error {
+			return Insert(tx, &Friend{Name: "Baz"})
+		})
+	})
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if cnt, _ := friendCount(db); cnt != 2 {
+		t.Fatalf("expected 2 got %d", cnt)
+	}
+
+	// the savepoint is rolled back after the context of fn is canceled
+	var innerErr error
+	err = db.Transact(ctx, func(tx Conn) error {
+		innerCtx, cancel := context.WithCancel(ctx)
+
+		innerErr = Transact(innerCtx, tx, func(tx Conn) error {
+			if err := Insert(tx, &Friend{Name: "Bar"}); err != nil {
+				return err
+			}
+			cancel()
+			return innerCtx.Err()
+		})
+		return nil
+	})
+
+	if innerErr != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, innerErr)
+	}
+
+	if cnt, _ := friendCount(db); err != nil || cnt != 2 {
+		t.Fatalf("expected 2, nil got %d, %v", cnt, err)
+	}
+
+	err = db.Transact(ctx, func(tx Conn) error {
+		if err := Insert(tx, &Friend{Name: "Qux"}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+
+	if err != errAbort {
+		t.Fatalf("expected %v got %v", errAbort, err)
+	}
+
+	func() {
+		defer func() {
+			if p := recover(); p == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+
+		db.Transact(ctx, func(tx Conn) error {
+			Insert(tx, &Friend{Name: "Qux"})
+			panic("boom")
+		})
+	}()
+
+	if cnt, _ := friendCount(db); cnt != 2 {
+		t.Fatalf("expected 2 got %d", cnt)
+	}
+}
+
+func TestTransactRetry(t *testing.T) {
+	db := dbFromConf(t)
+	db.MaxTxRetries = 2
+	var deadlock error = &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+	if _, ok := db.Dialect.(SqliteDialect); ok {
+		deadlock = errors.New("database is locked")
+	}
+
+	runs := 0
+	err := db.Transact(context.Background(), func(tx Conn) error {
+		runs++
+		if runs < 3 {
+			return deadlock
+		}
+		return nil
+	})
+
+	if err != nil || runs != 3 {
+		t.Fatalf("expected nil after 3 runs got %v after %d", err, runs)
+	}
+
+	runs = 0
+	err = db.Transact(context.Background(), func(tx Conn) error {
+		runs++
+		return deadlock
+	})
+
+	if err != deadlock || runs != 3 {
+		t.Fatalf("expected %v after 3 runs got %v after %d", deadlock, err, runs)
+	}
+	// a deadlock in a nested Transact whose savepoint the engine dropped
+	// is retried by the outer one
+	runs = 0
+	err = db.Transact(context.Background(), func(tx Conn) error {
+		runs++
+		return Transact(context.Background(), tx, func(tx Conn) error {
+			if runs > 1 {
+				return nil
+			}
+			if _, err := tx.Exec("RELEASE SAVEPOINT sp1"); err != nil {
+				return err
+			}
+			return deadlock
+		})
+	})
+
+	if err != nil || runs != 2 {
+		t.Fatalf("expected nil after 2 runs got %v after %d", err, runs)
+	}
+}
+
+func TestBeginx(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	var queries []string
+	db.Observer = QueryObserverFunc(func(ctx context.Context, e *QueryEvent) {
+		queries = append(queries, e.Query)
+	})
+	defer func() { db.Observer = nil }()
+
+	tx, err := db.Beginx()
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if err := Insert(tx, &Friend{Name: "a"}); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	var e *Error
+	if _, err := Exec(tx, "SELECT * FROM Missing"); !errors.As(err, &e) {
+		t.Fatalf("expected *Error got %v", err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if len(queries) != 2 {
+		t.Fatalf("expected 2 observed statements got %v", queries)
+	}
+}
+
+func TestTxRetryDelay(t *testing.T) {
+	for attempt, max := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond} {
+		if d := txRetryDelay(attempt); d < 0 || d >= max {
+			t.Errorf("%d: expected a delay below %v got %v", attempt, max, d)
+		}
+	}
+
+	if d := txRetryDelay(100); d >= time.Second {
+		t.Errorf("expected a delay below 1s got %v", d)
+	}
+}
@@ -0,0 +1,498 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// UpsertResult reports what Upsert did with a row.
+type UpsertResult int
+
+const (
+	// UpsertUnchanged means a conflicting row existed and was left as is.
+	UpsertUnchanged UpsertResult = iota
+	UpsertInserted
+	UpsertUpdated
+)
+
+func (r UpsertResult) String() string {
+	switch r {
+	case UpsertInserted:
+		return "inserted"
+	case UpsertUpdated:
+		return "updated"
+	default:
+		return "unchanged"
+	}
+}
+
+// UpsertOptions configures Upsert. Column names are resolved like
+// TableMap.ColMap, by struct field or column name.
+type UpsertOptions struct {
+	// ConflictColumns identify an existing row. Defaults to the primary
+	// keys, which is of no use for auto-increment keys as they are not
+	// inserted. MySQL ignores them and reacts to any unique key
+	// violation.
+	ConflictColumns []string
+
+	// UpdateColumns are overwritten when the row exists. Defaults to all
+	// columns except keys and conflict columns.
+	UpdateColumns []string
+
+	// Ignore leaves existing rows unchanged instead of updating them.
+	Ignore bool
+}
+
+// Upsert inserts each element of list, or updates the existing row when
+// the insert conflicts with it. It returns the result for every element.
+// Auto-increment ids are assigned for inserted rows and, where the engine
+// reports it, for updated rows. Tables with a version column are not
+// supported, as the update would bypass the optimistic lock.
+//
+// Whether a row exists is only known after the statement ran, so
+// PreInsert runs for every element, PostInsert only for inserted rows and
+// the update hooks never run. Inserted and updated rows record their
+// snapshot as Insert and Update do.
+func Upsert(exec Conn, list ...interface{}) ([]UpsertResult, error) {
+	return UpsertContext(context.Background(), exec, UpsertOptions{}, list...)
+}
+
+// UpsertWith is like Upsert with the given options.
+func UpsertWith(exec Conn, opts UpsertOptions, list ...interface{}) ([]UpsertResult, error) {
+	return UpsertContext(context.Background(), exec, opts, list...)
+}
+
+func UpsertContext(ctx context.Context, exec Conn, opts UpsertOptions, list ...interface{}) ([]UpsertResult, error) {
+	return queryUpsert(ctx, DefaultDBMap, exec, opts, list...)
+}
+
+// UpsertDialect is implemented by dialects supporting Upsert.
+type UpsertDialect interface {
+	// Upsert runs the statements for the row of a single element and
+	// returns its result, the generated or existing auto-increment id,
+	// or 0 if the engine does not report it, and the last statement
+	// run, which is the failing one when err is not nil.
+	Upsert(ctx context.Context, exec Conn, u *UpsertPlan, elem reflect.Value) (res UpsertResult, id int64, query string, err error)
+}
+
+// UpsertPlan holds the columns of an Upsert for one table.
+type UpsertPlan struct {
+	Table *TableMap
+
+	// Conflict are the columns identifying an existing row, and Update
+	// those written when it exists.
+	Conflict []*ColumnMap
+	Update   []*ColumnMap
+
+	// AutoIncr is the auto-increment key of Table, or nil.
+	AutoIncr *ColumnMap
+
+	// Ignore leaves existing rows unchanged.
+	Ignore bool
+
+	insert bindPlan
+
+	// allColumns is set when Update defaults to all columns
+	allColumns bool
+}
+
+func newUpsertPlan(table *TableMap, opts UpsertOptions) (*UpsertPlan, error) {
+	if table.version != nil {
+		return nil, fmt.Errorf("Upsert is not supported on table %s with a version column", table.TableName)
+	}
+
+	u := &UpsertPlan{Table: table, Ignore: opts.Ignore}
+
+	resolve := func(names []string) ([]*ColumnMap, error) {
+		cols := make([]*ColumnMap, 0, len(names))
+		for _, name := range names {
+			col := colMapOrNil(table, name)
+			if col == nil || col.Transient {
+				return nil, fmt.Errorf("Upsert: no column %s in table %s", name, table.TableName)
+			}
+			cols = append(cols, col)
+		}
+		return cols, nil
+	}
+
+	var err error
+	if u.Conflict, err = resolve(opts.ConflictColumns); err != nil {
+		return nil, err
+	}
+
+	if len(u.Conflict) == 0 {
+		u.Conflict = table.keys
+	}
+
+	if u.Update, err = resolve(opts.UpdateColumns); err != nil {
+		return nil, err
+	}
+
+	for _, col := range u.Update {
+		if col.ReadOnly {
+			return nil, fmt.Errorf("Upsert: cannot update read-only column %s in table %s", col.ColumnName, table.TableName)
+		}
+	}
+
+	if len(opts.UpdateColumns) == 0 {
+		u.allColumns = true
+		for _, col := range table.columns {
+			if !col.Transient && !col.isPK && !col.ReadOnly && !containsColumn(u.Conflict, col) {
+				u.Update = append(u.Update, col)
+			}
+		}
+	}
+
+	for _, col := range table.keys {
+		if col.isAutoIncr {
+			u.AutoIncr = col
+		}
+	}
+
+	if len(u.Conflict) == 0 && !u.Ignore {
+		return nil, fmt.Errorf("Upsert on table %s needs conflict columns", table.TableName)
+	}
+
+	return u, nil
+}
+
+func containsColumn(cols []*ColumnMap, col *ColumnMap) bool {
+	for _, c := range cols {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
+// InsertSQL returns the INSERT statement of the plan for dialect d up to
+// and including its values, with verb replacing "INSERT". Its arguments
+// are returned by Args.
+func (u *UpsertPlan) InsertSQL(d Dialect, verb string) string {
+	s := bytes.Buffer{}
+	s.WriteString(verb)
+	s.WriteString(strings.TrimPrefix(u.insert.insertHead, "INSERT"))
+	u.insert.writeValues(&s, d, 0)
+	return s.String()
+}
+
+// Args returns the arguments of InsertSQL for elem.
+func (u *UpsertPlan) Args(elem reflect.Value) []interface{} {
+	return u.insert.createBindInstance(elem).args
+}
+
+// Values returns the field values of cols in elem.
+func (u *UpsertPlan) Values(elem reflect.Value, cols []*ColumnMap) []interface{} {
+	args := make([]interface{}, 0, len(cols))
+	for _, col := range cols {
+		args = append(args, col.value(elem).Interface())
+	}
+	return args
+}
+
+// noopColumn returns the column assigned to itself by statements that
+// must not change an existing row.
+func (u *UpsertPlan) noopColumn() *ColumnMap {
+	if len(u.Conflict) > 0 {
+		return u.Conflict[0]
+	}
+	for _, col := range u.Table.columns {
+		if !col.Transient {
+			return col
+		}
+	}
+	return nil
+}
+
+// whereSql writes "a=? AND b=?" for cols, numbering bind variables from x.
+func whereSql(s *bytes.Buffer, d Dialect, cols []*ColumnMap, x int) {
+	for i, col := range cols {
+		if i > 0 {
+			s.WriteString(" AND ")
+		}
+		s.WriteString(d.QuoteField(col.ColumnName))
+		s.WriteString("=")
+		s.WriteString(d.BindVar(x + i))
+	}
+}
+
+func queryUpsert(ctx context.Context, m *DbMap, exec Conn, opts UpsertOptions, list ...interface{}) ([]UpsertResult, error) {
+	m = m.forConn(exec)
+
+	ud, ok := m.dialect().(UpsertDialect)
+
+	if !ok {
+		return nil, fmt.Errorf("Upsert is not supported by %T", m.dialect())
+	}
+
+	plans := make(map[*TableMap]*UpsertPlan)
+	results := make([]UpsertResult, 0, len(list))
+
+	for _, ptr := range list {
+		table, elem, err := tableForPointer(m, ptr, false)
+		if err != nil {
+			return results, err
+		}
+
+		u, ok := plans[table]
+		if !ok {
+			if u, err = newUpsertPlan(table, opts); err != nil {
+				return results, err
+			}
+			plans[table] = u
+		}
+
+		if v, ok := ptr.(PreInserter); ok {
+			if err := v.PreInsert(exec); err != nil {
+				return results, err
+			}
+		}
+
+		u.insert = table.insertBindPlan()
+
+		res, id, query, err := ud.Upsert(withOp(ctx, opUpsert, table.TableName), exec, u, elem)
+		if err != nil {
+			return results, wrapError(ctx, connDialect(m, exec), opUpsert, table.TableName, query, err)
+		}
+
+		if u.AutoIncr != nil && id > 0 {
+			setAutoIncr(u.AutoIncr.field(elem), id)
+		}
+
+		switch {
+		case res == UpsertInserted, res == UpsertUpdated && u.allColumns:
+			table.takeSnapshot(elem)
+		case res == UpsertUpdated:
+			table.updateSnapshot(elem, u.Update)
+		}
+
+		if v, ok := ptr.(PostInserter); ok && res == UpsertInserted {
+			if err := v.PostInsert(exec); err != nil {
+				return results, err
+			}
+		}
+
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+// upsertSql returns the INSERT ... ON DUPLICATE KEY UPDATE statement of
+// u. In ignore mode the existing row is assigned to itself, so that only
+// duplicate keys are ignored and not the other errors INSERT IGNORE
+// turns into warnings. LAST_INSERT_ID(pk) makes the id of an existing row
+// available.
+func (d MySQLDialect) upsertSql(u *UpsertPlan) string {
+	s := bytes.Buffer{}
+	s.WriteString(u.InsertSQL(d, "INSERT"))
+	s.WriteString(" ON DUPLICATE KEY UPDATE ")
+
+	var sets []string
+
+	if !u.Ignore {
+		for _, col := range u.Update {
+			c := d.QuoteField(col.ColumnName)
+			sets = append(sets, c+"=VALUES("+c+")")
+		}
+	}
+
+	if u.AutoIncr != nil {
+		c := d.QuoteField(u.AutoIncr.ColumnName)
+		sets = append(sets, c+"=LAST_INSERT_ID("+c+")")
+	} else if len(sets) == 0 {
+		c := d.QuoteField(u.noopColumn().ColumnName)
+		sets = append(sets, c+"="+c)
+	}
+
+	s.WriteString(strings.Join(sets, ", "))
+	return s.String()
+}
+
+// MySQL reports 1 affected row for an insert, 2 for an update and 0 for
+// an existing row left unchanged.
+func (d MySQLDialect) Upsert(ctx context.Context, exec Conn, u *UpsertPlan, elem reflect.Value) (UpsertResult, int64, string, error) {
+	query := d.upsertSql(u)
+
+	res, err := exec.ExecContext(ctx, query, u.Args(elem)...)
+	if err != nil {
+		return 0, 0, query, err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, query, err
+	}
+
+	var id int64
+	if u.AutoIncr != nil {
+		if id, err = res.LastInsertId(); err != nil {
+			return 0, 0, query, err
+		}
+	}
+
+	switch rows {
+	case 1:
+		return UpsertInserted, id, query, nil
+	case 2:
+		return UpsertUpdated, id, query, nil
+	default:
+		return UpsertUnchanged, id, query, nil
+	}
+}
+
+// conflictSql writes " ON CONFLICT (a, b)" for the conflict columns of u,
+// or " ON CONFLICT" if it has none.
+func conflictSql(s *bytes.Buffer, d Dialect, u *UpsertPlan) {
+	s.WriteString(" ON CONFLICT")
+
+	if len(u.Conflict) > 0 {
+		s.WriteString(" (")
+		for i, col := range u.Conflict {
+			if i > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(d.QuoteField(col.ColumnName))
+		}
+		s.WriteString(")")
+	}
+}
+
+// upsertSql returns the INSERT ... ON CONFLICT statement of u, returning
+// the auto-increment id and whether the row was inserted: Postgres sets
+// xmax to 0 for rows inserted by the statement.
+func (d PostgresDialect) upsertSql(u *UpsertPlan) string {
+	s := bytes.Buffer{}
+	s.WriteString(u.InsertSQL(d, "INSERT"))
+	conflictSql(&s, d, u)
+
+	if u.Ignore {
+		s.WriteString(" DO NOTHING")
+	} else {
+		s.WriteString(" DO UPDATE SET ")
+
+		update := u.Update
+		if len(update) == 0 {
+			update = u.Conflict[:1]
+		}
+
+		for i, col := range update {
+			if i > 0 {
+				s.WriteString(", ")
+			}
+			c := d.QuoteField(col.ColumnName)
+			s.WriteString(c + " = EXCLUDED." + c)
+		}
+	}
+
+	s.WriteString(" RETURNING ")
+	if u.AutoIncr != nil {
+		s.WriteString(d.QuoteField(u.AutoIncr.ColumnName) + ", ")
+	}
+	s.WriteString("(xmax = 0)")
+	return s.String()
+}
+
+func (d PostgresDialect) Upsert(ctx context.Context, exec Conn, u *UpsertPlan, elem reflect.Value) (UpsertResult, int64, string, error) {
+	query := d.upsertSql(u)
+
+	var id int64
+	var inserted bool
+	dest := []interface{}{&inserted}
+	if u.AutoIncr != nil {
+		dest = []interface{}{&id, &inserted}
+	}
+
+	err := exec.QueryRowxContext(ctx, query, u.Args(elem)...).Scan(dest...)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return UpsertUnchanged, 0, query, nil
+	case err != nil:
+		return 0, 0, query, err
+	case inserted:
+		return UpsertInserted, id, query, nil
+	default:
+		return UpsertUpdated, id, query, nil
+	}
+}
+
+// SQLite does not report whether ON CONFLICT DO UPDATE inserted or
+// updated a row, so the row is inserted with DO NOTHING and updated with
+// a separate statement matching the conflict columns if nothing was
+// inserted. Pass a transaction as exec to make this atomic.
+func (d SqliteDialect) Upsert(ctx context.Context, exec Conn, u *UpsertPlan, elem reflect.Value) (UpsertResult, int64, string, error) {
+	s := bytes.Buffer{}
+	s.WriteString(u.InsertSQL(d, "INSERT"))
+	conflictSql(&s, d, u)
+	s.WriteString(" DO NOTHING")
+	query := s.String()
+
+	res, err := exec.ExecContext(ctx, query, u.Args(elem)...)
+	if err != nil {
+		return 0, 0, query, err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, query, err
+	}
+
+	if rows > 0 {
+		id, err := res.LastInsertId()
+		return UpsertInserted, id, query, err
+	}
+
+	if len(u.Conflict) == 0 {
+		return UpsertUnchanged, 0, query, nil
+	}
+
+	result := UpsertUnchanged
+
+	if !u.Ignore && len(u.Update) > 0 {
+		s.Reset()
+		s.WriteString("UPDATE " + d.QuoteField(u.Table.TableName) + " SET ")
+		for i, col := range u.Update {
+			if i > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(d.QuoteField(col.ColumnName) + "=" + d.BindVar(i))
+		}
+		s.WriteString(" WHERE ")
+		whereSql(&s, d, u.Conflict, len(u.Update))
+		query = s.String()
+
+		args := append(u.Values(elem, u.Update), u.Values(elem, u.Conflict)...)
+		res, err := exec.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, 0, query, err
+		}
+
+		if rows, err = res.RowsAffected(); err != nil {
+			return 0, 0, query, err
+		}
+
+		if rows > 0 {
+			result = UpsertUpdated
+		}
+	}
+
+	var id int64
+	if u.AutoIncr != nil && !containsColumn(u.Conflict, u.AutoIncr) {
+		s.Reset()
+		s.WriteString("SELECT " + d.QuoteField(u.AutoIncr.ColumnName) + " FROM " + d.QuoteField(u.Table.TableName) + " WHERE ")
+		whereSql(&s, d, u.Conflict, 0)
+		query = s.String()
+
+		err := exec.QueryRowxContext(ctx, query, u.Values(elem, u.Conflict)...).Scan(&id)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, 0, query, err
+		}
+	}
+
+	return result, id, query, nil
+}
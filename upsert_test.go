@@ -0,0 +1,124 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+type Account struct {
+	AccountID int
+	Email     string
+	Name      string
+}
+
+func init() {
+	t := DefaultDBMap.AddTableWithName(Account{}, "Account").SetKeys(true, "AccountID")
+	t.ColMap("Email").SetUnique(true)
+}
+
+func TestUpsert(t *testing.T) {
+	db := dbFromConf(t)
+	setUp(t, db)
+	defer tearDown(t, db)
+
+	opts := UpsertOptions{ConflictColumns: []string{"Email"}}
+	a := &Account{Email: "a@example.com", Name: "A"}
+	b := &Account{Email: "b@example.com", Name: "B"}
+
+	res, err := UpsertWith(db, opts, a, b)
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if !reflect.DeepEqual(res, []UpsertResult{UpsertInserted, UpsertInserted}) || b.AccountID != 2 {
+		t.Fatalf("unexpected %v %+v", res, b)
+	}
+
+	b2 := &Account{Email: "b@example.com", Name: "B2"}
+	res, err = UpsertWith(db, opts, b2)
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if res[0] != UpsertUpdated || b2.AccountID != 2 {
+		t.Fatalf("unexpected %v %+v", res, b2)
+	}
+
+	opts.Ignore = true
+	b3 := &Account{Email: "b@example.com", Name: "B3"}
+	res, err = UpsertWith(db, opts, b3)
+
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	var got Account
+
+	if err := Get(db, &got, 2); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+
+	if res[0] != UpsertUnchanged || b3.AccountID != 2 || got.Name != "B2" {
+		t.Fatalf("unexpected %v %+v %+v", res, b3, got)
+	}
+
+	if _, err := UpsertWith(db, UpsertOptions{UpdateColumns: []string{"Nope"}}, a); err == nil {
+		t.Fatalf("expected unknown column error")
+	}
+}
+
+func TestUpsertSql(t *testing.T) {
+	plan := func(d Dialect, opts UpsertOptions) (*UpsertPlan, reflect.Value) {
+		table := NewDbMap(d).AddTableWithName(Account{}, "Account").SetKeys(true, "AccountID")
+		u, err := newUpsertPlan(table, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		elem := reflect.ValueOf(&Account{Email: "a@example.com", Name: "A"}).Elem()
+		table.bindInsert(elem)
+		u.insert = table.insertPlan
+		return u, elem
+	}
+
+	my := MySQLDialect{}
+	for _, tt := range []struct {
+		opts UpsertOptions
+		want string
+	}{
+		{UpsertOptions{ConflictColumns: []string{"Email"}},
+			"INSERT INTO `Account` (`AccountID`,`Email`,`Name`) VALUES (NULL,?,?) ON DUPLICATE KEY UPDATE `Name`=VALUES(`Name`), `AccountID`=LAST_INSERT_ID(`AccountID`)"},
+		{UpsertOptions{ConflictColumns: []string{"Email"}, Ignore: true},
+			"INSERT INTO `Account` (`AccountID`,`Email`,`Name`) VALUES (NULL,?,?) ON DUPLICATE KEY UPDATE `AccountID`=LAST_INSERT_ID(`AccountID`)"},
+	} {
+		u, _ := plan(my, tt.opts)
+		if got := my.upsertSql(u); got != tt.want {
+			t.Errorf("%+v: expected\n%s got\n%s", tt.opts, tt.want, got)
+		}
+	}
+
+	pg := PostgresDialect{}
+	for _, tt := range []struct {
+		opts UpsertOptions
+		want string
+	}{
+		{UpsertOptions{ConflictColumns: []string{"Email"}},
+			`INSERT INTO "Account" ("AccountID","Email","Name") VALUES (DEFAULT,$1,$2) ON CONFLICT ("Email") DO UPDATE SET "Name" = EXCLUDED."Name" RETURNING "AccountID", (xmax = 0)`},
+		{UpsertOptions{ConflictColumns: []string{"Email"}, Ignore: true},
+			`INSERT INTO "Account" ("AccountID","Email","Name") VALUES (DEFAULT,$1,$2) ON CONFLICT ("Email") DO NOTHING RETURNING "AccountID", (xmax = 0)`},
+	} {
+		u, _ := plan(pg, tt.opts)
+		if got := pg.upsertSql(u); got != tt.want {
+			t.Errorf("%+v: expected\n%s got\n%s", tt.opts, tt.want, got)
+		}
+	}
+}
+
+func TestUpsertVersioned(t *testing.T) {
+	db := dbFromConf(t)
+
+	if _, err := Upsert(db, &Note{Body: "a"}); err == nil {
+		t.Fatalf("expected error for a table with a version column")
+	}
+}